@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/KPI-team-labs/architecture-lab-4/datastore"
+)
+
+// SnapshotRespBody is returned by POST /admin/snapshot; Dir can be passed as
+// --dir to start a db from the snapshot.
+type SnapshotRespBody struct {
+	Dir string `json:"dir"`
+}
+
+func snapshotBaseDir() string {
+	if *snapshotDir != "" {
+		return *snapshotDir
+	}
+	// Hard links need the snapshots on the filesystem of the data files.
+	return filepath.Join(*dataDir, "snapshots")
+}
+
+func handleSnapshotRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dir := filepath.Join(snapshotBaseDir(), time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := Db.Snapshot(dir); err != nil {
+		log.Printf("Snapshot to %s failed: %s", dir, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(rw).Encode(SnapshotRespBody{Dir: dir})
+}
+
+// CompactReqBody is the body of POST /admin/compact: "run" compacts the
+// segments right away, "pause" and "resume" switch the automatic triggers.
+type CompactReqBody struct {
+	Action string `json:"action"`
+}
+
+// CompactionRespBody reports the compactions since the db started.
+type CompactionRespBody struct {
+	Running            bool       `json:"running"`
+	Paused             bool       `json:"paused"`
+	Runs               int        `json:"runs"`
+	Failures           int        `json:"failures"`
+	BytesReclaimed     int64      `json:"bytesReclaimed"`
+	LastBytesReclaimed int64      `json:"lastBytesReclaimed"`
+	LastSeconds        float64    `json:"lastSeconds"`
+	LastFinished       *time.Time `json:"lastFinished,omitempty"`
+	LastError          string     `json:"lastError,omitempty"`
+}
+
+// handleCompactRequest serves GET /admin/compact with the compaction stats and
+// POST /admin/compact with an action, answering with the stats after it.
+func handleCompactRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body CompactReqBody
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch body.Action {
+		case "run":
+			// Compaction may take longer than the write timeout of the server.
+			_ = http.NewResponseController(rw).SetWriteDeadline(time.Time{})
+			err := Db.Compact()
+			if errors.Is(err, datastore.ErrCompactionRunning) {
+				rw.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
+				log.Printf("Compaction failed: %s", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		case "pause":
+			Db.PauseCompaction()
+		case "resume":
+			Db.ResumeCompaction()
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	default:
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stats := Db.CompactionStats()
+	resp := CompactionRespBody{
+		Running:            stats.Running,
+		Paused:             stats.Paused,
+		Runs:               stats.Runs,
+		Failures:           stats.Failures,
+		BytesReclaimed:     stats.BytesReclaimed,
+		LastBytesReclaimed: stats.LastBytesReclaimed,
+		LastSeconds:        stats.LastDuration.Seconds(),
+	}
+	if !stats.LastFinished.IsZero() {
+		resp.LastFinished = &stats.LastFinished
+	}
+	if stats.LastError != nil {
+		resp.LastError = stats.LastError.Error()
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
+
+// SegmentStatsBody describes a segment file in GET /admin/stats.
+type SegmentStatsBody struct {
+	Number   int   `json:"number"`
+	Size     int64 `json:"size"`
+	LiveKeys int   `json:"liveKeys"`
+	Sorted   bool  `json:"sorted"`
+}
+
+// StatsRespBody is returned by GET /admin/stats; see datastore.Stats.
+type StatsRespBody struct {
+	Segments       []SegmentStatsBody `json:"segments"`
+	Keys           int                `json:"keys"`
+	DeadBytesRatio float64            `json:"deadBytesRatio"`
+	LastCompaction *time.Time         `json:"lastCompaction,omitempty"`
+	Puts           uint64             `json:"puts"`
+	Gets           uint64             `json:"gets"`
+}
+
+func handleStatsRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stats, err := Db.Stats()
+	if err != nil {
+		log.Printf("Reading the stats failed: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := StatsRespBody{
+		Segments:       make([]SegmentStatsBody, 0, len(stats.Segments)),
+		Keys:           stats.Keys,
+		DeadBytesRatio: stats.DeadBytesRatio,
+		Puts:           stats.Puts,
+		Gets:           stats.Gets,
+	}
+	for _, s := range stats.Segments {
+		resp.Segments = append(resp.Segments, SegmentStatsBody{
+			Number:   s.Number,
+			Size:     s.Size,
+			LiveKeys: s.LiveKeys,
+			Sorted:   s.Sorted,
+		})
+	}
+	if !stats.LastCompaction.IsZero() {
+		resp.LastCompaction = &stats.LastCompaction
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
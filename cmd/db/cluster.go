@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/KPI-team-labs/architecture-lab-4/httptools"
+	"github.com/KPI-team-labs/architecture-lab-4/sharding"
+	"github.com/KPI-team-labs/architecture-lab-4/signal"
+)
+
+const modeRouter = "router"
+
+// AddNodeReqBody is the body of POST /cluster/nodes.
+type AddNodeReqBody struct {
+	Address string `json:"address"`
+}
+
+func splitNodes(list string) []string {
+	var nodes []string
+	for _, node := range strings.Split(list, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, strings.TrimSuffix(node, "/"))
+		}
+	}
+	return nodes
+}
+
+func ringPath() string {
+	if *ringFile != "" {
+		return *ringFile
+	}
+	return filepath.Join(*dataDir, "ring.json")
+}
+
+// runRouter serves /db/ by forwarding the requests to the nodes owning the
+// keys; the router keeps no data itself, only the list of the nodes.
+func runRouter() {
+	path := ringPath()
+	nodes := splitNodes(*clusterNodes)
+	if _, err := os.Stat(path); len(nodes) == 0 && os.IsNotExist(err) {
+		log.Fatal("a router needs the addresses of the nodes")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Fatal(err)
+	}
+	router, err := sharding.OpenRouter(&http.Client{Timeout: 10 * time.Second}, path, nodes...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &server{ServeMux: http.NewServeMux()}
+	s.Handle("/db/", router)
+	s.HandleFunc("/cluster", func(rw http.ResponseWriter, req *http.Request) {
+		handleClusterRequest(rw, req, router)
+	})
+	s.HandleFunc("/cluster/nodes", func(rw http.ResponseWriter, req *http.Request) {
+		handleAddNodeRequest(rw, req, router)
+	})
+
+	httpServer := httptools.CreateServer(*port, s)
+	httpServer.Start()
+
+	signal.WaitForTerminationSignal()
+}
+
+func handleClusterRequest(rw http.ResponseWriter, req *http.Request, router *sharding.Router) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(router.Status())
+}
+
+func handleAddNodeRequest(rw http.ResponseWriter, req *http.Request, router *sharding.Router) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var body AddNodeReqBody
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Address == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := router.AddNode(strings.TrimSuffix(body.Address, "/"))
+	if errors.Is(err, sharding.ErrMigrating) {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
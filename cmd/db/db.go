@@ -1,29 +1,89 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/KPI-team-labs/architecture-lab-4/datastore"
 	"github.com/KPI-team-labs/architecture-lab-4/httptools"
 	"github.com/KPI-team-labs/architecture-lab-4/signal"
 )
 
-var port = flag.Int("port", 8083, "server port")
+const (
+	confDataDir             = "CONF_DATA_DIR"
+	confSegmentSize         = "CONF_SEGMENT_SIZE"
+	confCompactionThreshold = "CONF_COMPACTION_THRESHOLD"
+	confDurability          = "CONF_DURABILITY"
+	confGroupCommitMs       = "CONF_GROUP_COMMIT_MS"
+	confGroupCommitWrites   = "CONF_GROUP_COMMIT_WRITES"
+	confCompression         = "CONF_COMPRESSION"
+	confSnapshotDir         = "CONF_SNAPSHOT_DIR"
+	confMode                = "CONF_MODE"
+	confPrimary             = "CONF_PRIMARY"
+	confNodes               = "CONF_NODES"
+	confRingFile            = "CONF_RING_FILE"
+	confRetention           = "CONF_RETENTION"
+	confCompactionBytes     = "CONF_COMPACTION_BYTES"
+	confCompactionRatio     = "CONF_COMPACTION_RATIO"
+)
+
+var (
+	port                = flag.Int("port", 8083, "server port")
+	dataDir             = flag.String("dir", envString(confDataDir, "/opt/practice-4/data"), "directory for the segment files")
+	segmentSize         = flag.Int("segment-size", envInt(confSegmentSize, 10*1024*1024), "max size of a segment file in bytes")
+	compactionThreshold = flag.Int("compaction-threshold", envInt(confCompactionThreshold, 3), "number of segments that triggers compaction")
+	durability          = flag.String("durability", envString(confDurability, "none"), "fsync mode of writes: none, sync or group")
+	groupCommitMs       = flag.Int("group-commit-ms", envInt(confGroupCommitMs, 10), "max delay of a group commit in milliseconds")
+	groupCommitWrites   = flag.Int("group-commit-writes", envInt(confGroupCommitWrites, 64), "number of writes that triggers a group commit")
+	compression         = flag.String("compression", envString(confCompression, "none"), "compression of stored values: none or gzip")
+	snapshotDir         = flag.String("snapshot-dir", envString(confSnapshotDir, ""), "directory for snapshots, <dir>/snapshots by default")
+	mode                = flag.String("mode", envString(confMode, modePrimary), "role: primary, replica or router")
+	primary             = flag.String("primary", envString(confPrimary, ""), "address of the primary a replica copies, e.g. http://db:8083")
+	clusterNodes        = flag.String("nodes", envString(confNodes, ""), "comma-separated addresses of the nodes a router forwards to")
+	ringFile            = flag.String("ring-file", envString(confRingFile, ""), "file a router keeps its nodes in, <dir>/ring.json by default")
+	retention           = flag.Int("retention", envInt(confRetention, 1), "number of latest versions of a key compaction keeps")
+	compactionBytes     = flag.Int("compaction-bytes", envInt(confCompactionBytes, 0), "size of the inactive segments in bytes that triggers compaction, 0 to disable")
+	compactionRatio     = flag.Float64("compaction-ratio", envFloat(confCompactionRatio, 0), "ratio of the new segments to the compacted one that triggers compaction, 0 to disable")
+)
 
+// RespBody is a value of a key; TTL is the number of seconds left until a
+// value written with a TTL expires.
 type RespBody struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	Type  string `json:"type"`
+	TTL   int64  `json:"ttl,omitempty"`
 }
 
+// ReqBody is the body of POST /db/{key}. When Expected is set the value is
+// written with compare-and-swap; when Delta is set the int64 value is incremented.
+// TTL is in seconds and is supported for string values only.
 type ReqBody struct {
-	Value string `json:"value"`
+	Value    string  `json:"value"`
+	Type     string  `json:"type"`
+	Expected *string `json:"expected,omitempty"`
+	Delta    *int64  `json:"delta,omitempty"`
+	TTL      int64   `json:"ttl,omitempty"`
 }
 
+// ListRespBody is a page of GET /db/?prefix=...&limit=...; Cursor is set when
+// there may be more keys and should be passed as ?cursor= to get the next page.
+type ListRespBody struct {
+	Items  []RespBody `json:"items"`
+	Cursor string     `json:"cursor,omitempty"`
+}
+
+// BatchReqBody maps keys to the string values written by a single batch.
+type BatchReqBody map[string]string
+
 type server struct {
 	*http.ServeMux
 }
@@ -31,19 +91,92 @@ type server struct {
 func main() {
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "fsck":
+		os.Exit(runFsck(flag.Args()[1:]))
+	case "migrate":
+		os.Exit(runMigrate(flag.Args()[1:]))
+	}
+
+	switch *mode {
+	case modePrimary, modeReplica:
+	case modeRouter:
+		runRouter()
+		return
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+
 	s := &server{ServeMux: http.NewServeMux()}
-	dir, err := ioutil.TempDir("", "temp-dir")
+	if err := os.MkdirAll(*dataDir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	if *mode == modeReplica && *primary == "" {
+		log.Fatal("a replica needs the address of the primary")
+	}
+	durabilityMode, err := datastore.ParseDurability(*durability)
 	if err != nil {
 		log.Fatal(err)
 	}
-	db, err := datastore.NewDb(dir, 250)
+	codec, err := datastore.ParseCompression(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []datastore.Option{
+		datastore.WithCompactionThreshold(*compactionThreshold),
+		datastore.WithCompactionBytes(int64(*compactionBytes)),
+		datastore.WithCompactionRatio(*compactionRatio),
+		datastore.WithDurability(durabilityMode),
+		datastore.WithCompression(codec),
+		datastore.WithRetention(*retention),
+	}
+	if durabilityMode == datastore.DurabilityGroupCommit {
+		opts = append(opts, datastore.WithGroupCommit(time.Duration(*groupCommitMs)*time.Millisecond, *groupCommitWrites))
+	}
+
+	db, err := datastore.NewDb(*dataDir, int64(*segmentSize), opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	s.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
+	dbHandler := func(rw http.ResponseWriter, req *http.Request) {
 		handleDBRequest(rw, req, db)
+	}
+	batchHandler := func(rw http.ResponseWriter, req *http.Request) {
+		handleBatchRequest(rw, req, db)
+	}
+	var repl *replicator
+	if *mode == modeReplica {
+		open := func(dir string) (*datastore.Db, error) {
+			return datastore.NewDb(dir, int64(*segmentSize), opts...)
+		}
+		if repl, err = newReplicator(db, *primary, open); err != nil {
+			log.Fatal(err)
+		}
+		go repl.run()
+		dbHandler, batchHandler = readOnly(dbHandler), readOnly(batchHandler)
+	} else {
+		s.HandleFunc("/replication/log", func(rw http.ResponseWriter, req *http.Request) {
+			handleLogRequest(rw, req, db)
+		})
+	}
+	s.HandleFunc("/db/", dbHandler)
+	s.HandleFunc("/db/_batch", batchHandler)
+	s.HandleFunc("/db/_watch", func(rw http.ResponseWriter, req *http.Request) {
+		handleWatchRequest(rw, req, db)
+	})
+	s.HandleFunc("/replication/status", func(rw http.ResponseWriter, req *http.Request) {
+		handleReplicationStatus(rw, req, db, repl)
+	})
+	s.HandleFunc("/admin/snapshot", func(rw http.ResponseWriter, req *http.Request) {
+		handleSnapshotRequest(rw, req, db)
+	})
+	s.HandleFunc("/admin/compact", func(rw http.ResponseWriter, req *http.Request) {
+		handleCompactRequest(rw, req, db)
+	})
+	s.HandleFunc("/admin/stats", func(rw http.ResponseWriter, req *http.Request) {
+		handleStatsRequest(rw, req, db)
 	})
 
 	httpServer := httptools.CreateServer(*port, s)
@@ -52,6 +185,37 @@ func main() {
 	signal.WaitForTerminationSignal()
 }
 
+func envString(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) int {
+	env := os.Getenv(name)
+	if env == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(env)
+	if err != nil {
+		log.Fatalf("invalid %s: %q is not an integer", name, env)
+	}
+	return value
+}
+
+func envFloat(name string, fallback float64) float64 {
+	env := os.Getenv(name)
+	if env == "" {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(env, 64)
+	if err != nil {
+		log.Fatalf("invalid %s: %q is not a number", name, env)
+	}
+	return value
+}
+
 func (s *server) Start() {
 	log.Printf("Server listening on port %d", *port)
 	err := http.ListenAndServe(":"+strconv.Itoa(*port), s)
@@ -67,17 +231,29 @@ func handleDBRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db
 
 	switch req.Method {
 	case http.MethodGet:
-		value, err := Db.Get(key)
-		if err != nil {
+		if key == "" {
+			handleListRequest(rw, req, Db)
+			return
+		}
+		if strings.HasSuffix(key, historySuffix) {
+			handleHistoryRequest(rw, req, Db, strings.TrimSuffix(key, historySuffix))
+			return
+		}
+		if req.URL.Query().Has("version") {
+			handleVersionRequest(rw, req, Db, key)
+			return
+		}
+		body, err := getValue(Db, key)
+		if errors.Is(err, datastore.ErrNotFound) {
 			rw.WriteHeader(http.StatusNotFound)
 			return
+		} else if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-		rw.WriteHeader(http.StatusOK)
 		rw.Header().Set("content-type", "application/json")
-		_ = json.NewEncoder(rw).Encode(RespBody{
-			Key:   key,
-			Value: value,
-		})
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(body)
 	case http.MethodPost:
 		var body ReqBody
 
@@ -87,13 +263,156 @@ func handleDBRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db
 			return
 		}
 
-		err = Db.Put(key, body.Value)
+		if body.Delta != nil {
+			handleIncrement(rw, Db, key, *body.Delta)
+			return
+		}
+		if body.Expected != nil {
+			handleCompareAndSwap(rw, Db, key, *body.Expected, body.Value)
+			return
+		}
+
+		valueType, err := datastore.ParseValueType(body.Type)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		value, err := parseValue(valueType, body.Value)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if body.TTL < 0 || (body.TTL > 0 && valueType != datastore.TypeString) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if body.TTL > 0 {
+			err = Db.PutWithTTL(key, body.Value, time.Duration(body.TTL)*time.Second)
+		} else {
+			err = putValue(Db, key, value)
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		err := Db.Delete(key)
 		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		rw.WriteHeader(http.StatusOK)
+	default:
+		rw.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+func handleListRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	query := req.URL.Query()
+	prefix := query.Get("prefix")
+
+	limit := defaultListLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+
+	start := prefix
+	if cursor := query.Get("cursor"); cursor != "" {
+		last, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The smallest key after the last one of the previous page.
+		start = string(last) + "\x00"
+	}
+
+	resp := ListRespBody{Items: make([]RespBody, 0)}
+	it := Db.ScanFrom(prefix, start)
+	for len(resp.Items) < limit && it.Next() {
+		resp.Items = append(resp.Items, RespBody{
+			Key:   it.Key(),
+			Value: formatValue(it),
+			Type:  it.Type().String(),
+		})
+	}
+	if err := it.Err(); err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(resp.Items) == limit && it.Next() {
+		resp.Cursor = base64.RawURLEncoding.EncodeToString([]byte(resp.Items[limit-1].Key))
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
+
+func handleIncrement(rw http.ResponseWriter, Db *datastore.Db, key string, delta int64) {
+	value, err := Db.Increment(key, delta)
+	if errors.Is(err, datastore.ErrTypeMismatch) {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(RespBody{
+		Key:   key,
+		Value: strconv.FormatInt(value, 10),
+		Type:  datastore.TypeInt64.String(),
+	})
+}
+
+func handleCompareAndSwap(rw http.ResponseWriter, Db *datastore.Db, key, expected, value string) {
+	err := Db.CompareAndSwap(key, expected, value)
+	switch {
+	case err == nil:
 		rw.WriteHeader(http.StatusCreated)
+	case errors.Is(err, datastore.ErrNotFound):
+		rw.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, datastore.ErrConflict), errors.Is(err, datastore.ErrTypeMismatch):
+		rw.WriteHeader(http.StatusConflict)
 	default:
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func handleBatchRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	if req.Method != http.MethodPost {
 		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var body BatchReqBody
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = Db.PutBatch(body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	rw.WriteHeader(http.StatusCreated)
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/KPI-team-labs/architecture-lab-4/datastore"
+)
+
+// runFsck implements `db fsck [-repair]`: it checks the segments in the data
+// directory and returns the process exit code.
+func runFsck(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "truncate a torn record at the end of the last segment")
+	_ = fs.Parse(args)
+
+	check := datastore.Verify
+	if *repair {
+		check = datastore.Repair
+	}
+	found, err := check(*dataDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	for _, c := range found {
+		fmt.Println(c)
+	}
+	if len(found) == 0 {
+		fmt.Println("no corrupted records found")
+		return 0
+	}
+	if *repair {
+		// Report what is left after the torn tail is gone.
+		if found, err = datastore.Verify(*dataDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if len(found) == 0 {
+			fmt.Println("repaired")
+			return 0
+		}
+	}
+	return 1
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/KPI-team-labs/architecture-lab-4/datastore"
+)
+
+// historySuffix turns GET /db/{key} into a request for the versions of the key.
+const historySuffix = "/history"
+
+// VersionBody is a version of a key in GET /db/{key}/history; Version is the
+// sequence number of the write that can be passed as ?version= to GET /db/{key}.
+type VersionBody struct {
+	Version uint64 `json:"version"`
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// HistoryRespBody lists the versions of a key, newest first.
+type HistoryRespBody struct {
+	Key      string        `json:"key"`
+	Versions []VersionBody `json:"versions"`
+}
+
+// handleVersionRequest serves GET /db/{key}?version=N with the value the key
+// held after the write N.
+func handleVersionRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db, key string) {
+	seq, err := strconv.ParseUint(req.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	v, err := Db.GetAt(key, seq)
+	if errors.Is(err, datastore.ErrNotFound) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(RespBody{
+		Key:   key,
+		Value: formatVersion(v),
+		Type:  v.Type.String(),
+	})
+}
+
+// handleHistoryRequest serves GET /db/{key}/history?limit=N.
+func handleHistoryRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db, key string) {
+	limit := 0
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	history, err := Db.History(key, limit)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(history) == 0 {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resp := HistoryRespBody{Key: key, Versions: make([]VersionBody, 0, len(history))}
+	for _, v := range history {
+		body := VersionBody{Version: v.Seq, Deleted: v.Deleted}
+		if !v.Deleted {
+			body.Value = formatVersion(v)
+			body.Type = v.Type.String()
+		}
+		resp.Versions = append(resp.Versions, body)
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/KPI-team-labs/architecture-lab-4/datastore"
+)
+
+// runMigrate implements `db migrate`: it rewrites the segments of older
+// formats in the data directory and returns the process exit code.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	migrated, err := datastore.Migrate(*dataDir)
+	for _, path := range migrated {
+		fmt.Println("migrated", path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(migrated) == 0 {
+		fmt.Println("all segments are up to date")
+	}
+	return 0
+}
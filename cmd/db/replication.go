@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/KPI-team-labs/architecture-lab-4/datastore"
+)
+
+const (
+	modePrimary = "primary"
+	modeReplica = "replica"
+
+	// positionFileName keeps the log position a replica has applied, so it
+	// resumes from there after a restart.
+	positionFileName = "replication-position"
+	// resyncDirName is the directory under the data directory a replica
+	// copies the whole log of the primary to before it swaps the copy in.
+	resyncDirName = "resync"
+
+	replicationBatchSize    = 1 << 20
+	replicationPollInterval = 100 * time.Millisecond
+	replicationRetryDelay   = time.Second
+
+	headerSegment = "Replication-Segment"
+	headerOffset  = "Replication-Offset"
+	headerLag     = "Replication-Lag"
+)
+
+// ReplicationStatus is returned by GET /replication/status. LagBytes is how
+// much of the primary's log the replica hasn't applied yet and LagSeconds is
+// how long ago it was last caught up.
+type ReplicationStatus struct {
+	Mode        string                `json:"mode"`
+	Primary     string                `json:"primary,omitempty"`
+	Position    datastore.LogPosition `json:"position"`
+	LagBytes    int64                 `json:"lagBytes"`
+	LagSeconds  float64               `json:"lagSeconds"`
+	LastContact *time.Time            `json:"lastContact,omitempty"`
+	Error       string                `json:"error,omitempty"`
+}
+
+// handleLogRequest serves GET /replication/log?segment=...&offset=... to replicas.
+func handleLogRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var pos datastore.LogPosition
+	var err error
+	query := req.URL.Query()
+	if s := query.Get("segment"); s != "" {
+		if pos.Segment, err = strconv.Atoi(s); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("offset"); s != "" {
+		if pos.Offset, err = strconv.ParseInt(s, 10, 64); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, next, lag, err := Db.ReadLog(pos, replicationBatchSize)
+	if errors.Is(err, datastore.ErrLogTruncated) {
+		rw.WriteHeader(http.StatusGone)
+		return
+	} else if err != nil {
+		log.Printf("Cannot read the log at %+v: %s", pos, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("content-type", "application/octet-stream")
+	rw.Header().Set(headerSegment, strconv.Itoa(next.Segment))
+	rw.Header().Set(headerOffset, strconv.FormatInt(next.Offset, 10))
+	rw.Header().Set(headerLag, strconv.FormatInt(lag, 10))
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(records)
+}
+
+// replicator pulls the log of the primary and applies it to the local Db.
+type replicator struct {
+	db      *datastore.Db
+	primary string
+	client  *http.Client
+	// open opens a Db with the options of db in another directory.
+	open func(dir string) (*datastore.Db, error)
+
+	started time.Time
+
+	mu          sync.Mutex
+	pos         datastore.LogPosition
+	lagBytes    int64
+	caughtUp    time.Time
+	lastContact time.Time
+	err         error
+}
+
+func newReplicator(db *datastore.Db, primary string, open func(dir string) (*datastore.Db, error)) (*replicator, error) {
+	r := &replicator{
+		db:      db,
+		primary: primary,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		open:    open,
+		started: time.Now(),
+	}
+	// Left by a resync that didn't finish; it starts over anyway.
+	if err := os.RemoveAll(filepath.Join(*dataDir, resyncDirName)); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(r.positionPath())
+	if err == nil {
+		err = json.Unmarshal(data, &r.pos)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	return r, err
+}
+
+func (r *replicator) positionPath() string {
+	return filepath.Join(*dataDir, positionFileName)
+}
+
+func (r *replicator) run() {
+	for {
+		next, lag, err := r.pull(r.db, r.pos)
+		if err == nil {
+			err = r.setPosition(next)
+		}
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+
+		switch {
+		case errors.Is(err, datastore.ErrLogTruncated):
+			log.Printf("Replication position %+v was compacted on the primary, copying everything again", r.pos)
+			if err := r.resync(); err != nil {
+				log.Printf("Cannot reset the replica: %s", err)
+				time.Sleep(replicationRetryDelay)
+			}
+		case err != nil:
+			log.Printf("Replication failed: %s", err)
+			time.Sleep(replicationRetryDelay)
+		case lag == 0:
+			time.Sleep(replicationPollInterval)
+		}
+	}
+}
+
+// pull applies the batch of records after pos to db and returns the position
+// after them and the lag there.
+func (r *replicator) pull(db *datastore.Db, pos datastore.LogPosition) (datastore.LogPosition, int64, error) {
+	var next datastore.LogPosition
+	query := url.Values{}
+	query.Set("segment", strconv.Itoa(pos.Segment))
+	query.Set("offset", strconv.FormatInt(pos.Offset, 10))
+	resp, err := r.client.Get(r.primary + "/replication/log?" + query.Encode())
+	if err != nil {
+		return next, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return next, 0, datastore.ErrLogTruncated
+	} else if resp.StatusCode != http.StatusOK {
+		return next, 0, fmt.Errorf("primary responded with %s", resp.Status)
+	}
+	next.Segment, err = strconv.Atoi(resp.Header.Get(headerSegment))
+	if err != nil {
+		return next, 0, fmt.Errorf("bad %s header: %w", headerSegment, err)
+	}
+	next.Offset, err = strconv.ParseInt(resp.Header.Get(headerOffset), 10, 64)
+	if err != nil {
+		return next, 0, fmt.Errorf("bad %s header: %w", headerOffset, err)
+	}
+	lag, err := strconv.ParseInt(resp.Header.Get(headerLag), 10, 64)
+	if err != nil {
+		return next, 0, fmt.Errorf("bad %s header: %w", headerLag, err)
+	}
+	records, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return next, 0, err
+	}
+
+	if err := db.Apply(records); err != nil {
+		return next, 0, err
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	r.lagBytes = lag
+	r.lastContact = now
+	if lag == 0 {
+		r.caughtUp = now
+	}
+	r.mu.Unlock()
+	return next, lag, nil
+}
+
+// setPosition stores the position after the applied records. Records
+// applied again after a crash before it's stored just rewrite the same values.
+func (r *replicator) setPosition(pos datastore.LogPosition) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	tmpPath := r.positionPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, r.positionPath()); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.pos = pos
+	r.mu.Unlock()
+	return nil
+}
+
+// resync copies the primary's log from the beginning to a new Db and swaps
+// it in for the local data, because deletes in the compacted part of the log
+// are lost. The replica keeps serving the old data until the copy catches up.
+func (r *replicator) resync() error {
+	dir := filepath.Join(*dataDir, resyncDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	fresh, err := r.open(dir)
+	if err != nil {
+		return err
+	}
+
+	var pos datastore.LogPosition
+	for {
+		next, lag, err := r.pull(fresh, pos)
+		if err != nil {
+			fresh.Close()
+			return err
+		}
+		pos = next
+		if lag == 0 {
+			break
+		}
+	}
+	if err := r.db.Replace(fresh); err != nil {
+		return err
+	}
+	return r.setPosition(pos)
+}
+
+func (r *replicator) status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := ReplicationStatus{
+		Mode:     modeReplica,
+		Primary:  r.primary,
+		Position: r.pos,
+		LagBytes: r.lagBytes,
+	}
+	if !r.lastContact.IsZero() {
+		lastContact := r.lastContact
+		res.LastContact = &lastContact
+	}
+	if r.lagBytes > 0 || r.caughtUp.IsZero() {
+		since := r.caughtUp
+		if since.IsZero() {
+			since = r.started
+		}
+		res.LagSeconds = time.Since(since).Seconds()
+	}
+	if r.err != nil {
+		res.Error = r.err.Error()
+	}
+	return res
+}
+
+// handleReplicationStatus serves GET /replication/status; repl is nil on the primary.
+func handleReplicationStatus(rw http.ResponseWriter, req *http.Request, Db *datastore.Db, repl *replicator) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	status := ReplicationStatus{Mode: modePrimary, Position: Db.Head()}
+	if repl != nil {
+		status = repl.status()
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(status)
+}
+
+// readOnly rejects the requests that would change the data of a replica.
+func readOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler(rw, req)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/KPI-team-labs/architecture-lab-4/datastore"
+)
+
+// getValue reads the key once and formats it for JSON: int64 values as
+// decimal strings, bytes as standard base64.
+func getValue(db *datastore.Db, key string) (RespBody, error) {
+	v, err := db.GetVersion(key)
+	if err != nil {
+		return RespBody{}, err
+	}
+	res := RespBody{Key: key, Value: formatVersion(v), Type: v.Type.String()}
+	if !v.ExpiresAt.IsZero() {
+		// Rounded up, so a value that is still there is never reported
+		// as expired or permanent.
+		res.TTL = int64(math.Ceil(time.Until(v.ExpiresAt).Seconds()))
+		if res.TTL < 1 {
+			res.TTL = 1
+		}
+	}
+	return res, nil
+}
+
+// formatValue formats the current value of the iterator the same way getValue does.
+func formatValue(it *datastore.Iterator) string {
+	switch it.Type() {
+	case datastore.TypeInt64:
+		value, _ := it.Int64()
+		return strconv.FormatInt(value, 10)
+	case datastore.TypeBytes:
+		return base64.StdEncoding.EncodeToString([]byte(it.Value()))
+	default:
+		return it.Value()
+	}
+}
+
+// formatVersion formats a version of a key the same way getValue does.
+func formatVersion(v datastore.Version) string {
+	switch v.Type {
+	case datastore.TypeInt64:
+		value, _ := v.Int64()
+		return strconv.FormatInt(value, 10)
+	case datastore.TypeBytes:
+		return base64.StdEncoding.EncodeToString([]byte(v.Value))
+	default:
+		return v.Value
+	}
+}
+
+// parseValue checks that the request value can be stored as the given type.
+func parseValue(valueType datastore.ValueType, value string) (interface{}, error) {
+	switch valueType {
+	case datastore.TypeInt64:
+		return strconv.ParseInt(value, 10, 64)
+	case datastore.TypeBytes:
+		return base64.StdEncoding.DecodeString(value)
+	default:
+		return value, nil
+	}
+}
+
+func putValue(db *datastore.Db, key string, value interface{}) error {
+	switch v := value.(type) {
+	case int64:
+		return db.PutInt64(key, v)
+	case []byte:
+		return db.PutBytes(key, v)
+	default:
+		return db.Put(key, v.(string))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KPI-team-labs/architecture-lab-4/datastore"
+)
+
+// watchHeartbeat is how often an idle change feed sends a comment, so proxies
+// don't close the connection and a client that went away is noticed.
+const watchHeartbeat = 15 * time.Second
+
+// handleWatchRequest serves GET /db/_watch?prefix=... as a stream of
+// Server-Sent Events, one per change. The id of an event is the sequence
+// number of the write, so a client reconnecting with Last-Event-ID (or
+// ?from=N) gets the changes it missed.
+func handleWatchRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	from := req.Header.Get("Last-Event-ID")
+	if from == "" {
+		from = req.URL.Query().Get("from")
+	}
+	prefix := req.URL.Query().Get("prefix")
+
+	var w *datastore.Watcher
+	if from == "" {
+		w = Db.Watch(prefix)
+	} else {
+		seq, err := strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w, err = Db.WatchFrom(prefix, seq)
+		if errors.Is(err, datastore.ErrLogTruncated) {
+			rw.WriteHeader(http.StatusGone)
+			return
+		} else if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	defer w.Stop()
+
+	// The stream outlives the write timeout of the server.
+	rc := http.NewResponseController(rw)
+	_ = rc.SetWriteDeadline(time.Time{})
+	rw.Header().Set("content-type", "text/event-stream")
+	rw.Header().Set("cache-control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-w.C:
+			if !ok {
+				// The client resumes from the last event it got.
+				return
+			}
+			if err := writeEvent(rw, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(rw, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(rw http.ResponseWriter, e datastore.Event) error {
+	event := "put"
+	body := RespBody{Key: e.Key}
+	if e.Deleted {
+		event = "delete"
+	} else {
+		body.Value = formatVersion(e.Version)
+		body.Type = e.Type.String()
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, event, data)
+	return err
+}
@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"hash/fnv"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// bloomFilter answers whether a key may be in a sorted segment without
+// reading the file. False positives are possible, false negatives are not.
+type bloomFilter struct {
+	bits []uint64
+	m    uint32
+}
+
+func newBloomFilter(n int) *bloomFilter {
+	m := uint32(n * bloomBitsPerKey)
+	if m < 64 {
+		m = 64
+	}
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+	}
+}
+
+// hashes derives the bit positions of the key with double hashing.
+func (f *bloomFilter) hashes(key string) [bloomHashes]uint32 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+
+	var res [bloomHashes]uint32
+	for i := range res {
+		res[i] = (h1 + uint32(i)*h2) % f.m
+	}
+	return res
+}
+
+func (f *bloomFilter) add(key string) {
+	for _, bit := range f.hashes(key) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	for _, bit := range f.hashes(key) {
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package datastore
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCompactionRunning is returned by Compact while another compaction runs.
+var ErrCompactionRunning = errors.New("compaction is already running")
+
+// errSegmentsChanged means that the sources of a compaction were no longer
+// the oldest segments when it was about to swap them.
+var errSegmentsChanged = errors.New("segments changed during compaction")
+
+// compaction is the state of the compaction manager, guarded by db.mu. At
+// most one compaction runs at a time; a trigger firing meanwhile is checked
+// again on the next rollover.
+type compaction struct {
+	running bool
+	paused  bool
+	// done gets the result of the running compaction.
+	done chan error
+	// finished is closed once the running compaction ends.
+	finished chan struct{}
+	stats    CompactionStats
+}
+
+// CompactionStats reports the compactions since the Db was opened. A
+// compaction reclaims the size of its sources less the size of the merged
+// segment.
+type CompactionStats struct {
+	Running            bool
+	Paused             bool
+	Runs               int
+	Failures           int
+	BytesReclaimed     int64
+	LastBytesReclaimed int64
+	LastDuration       time.Duration
+	LastFinished       time.Time
+	LastError          error
+}
+
+// WithCompactionBytes starts compaction when the inactive segments hold at
+// least n bytes. Zero disables the trigger.
+func WithCompactionBytes(n int64) Option {
+	return func(db *Db) {
+		db.compactionBytes = n
+	}
+}
+
+// WithCompactionRatio starts compaction when the inactive segments written
+// since the last compaction are at least r times the size of the segment it
+// wrote, so the work done stays proportional to the data added. Zero
+// disables the trigger.
+func WithCompactionRatio(r float64) Option {
+	return func(db *Db) {
+		db.compactionRatio = r
+	}
+}
+
+// CompactionStats returns the state of compaction and the results of the
+// past runs.
+func (db *Db) CompactionStats() CompactionStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stats := db.compaction.stats
+	stats.Running = db.compaction.running
+	stats.Paused = db.compaction.paused
+	return stats
+}
+
+// PauseCompaction keeps the triggers from starting compaction until
+// ResumeCompaction. A compaction already running finishes.
+func (db *Db) PauseCompaction() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.compaction.paused = true
+}
+
+func (db *Db) ResumeCompaction() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.compaction.paused = false
+}
+
+// Compact rolls the active segment over and merges all the other segments,
+// even when compaction is paused, and waits for it to finish.
+func (db *Db) Compact() error {
+	var done chan error
+	err := db.submit(putOp{run: func() error {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if db.compaction.running {
+			return ErrCompactionRunning
+		}
+		if err := db.rollOver(true); err != nil {
+			return err
+		}
+		done = db.compaction.done
+		return nil
+	}})
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// compactionDue tells whether a trigger fires for the segments there will be
+// after the active one is rolled over. The caller must hold db.mu.
+func (db *Db) compactionDue() bool {
+	if db.compaction.running || db.compaction.paused || len(db.segments) == 0 {
+		return false
+	}
+	if len(db.segments)+1 >= db.compactionThreshold {
+		return true
+	}
+
+	var total, base int64
+	for i, s := range db.segments {
+		size := s.outOffset
+		if i == len(db.segments)-1 {
+			size = db.outOffset
+		}
+		total += size
+		if i == 0 && s.isSorted() {
+			base = size
+		}
+	}
+	if db.compactionBytes > 0 && total >= db.compactionBytes {
+		return true
+	}
+	return db.compactionRatio > 0 && len(db.segments) > 1 &&
+		float64(total-base) >= db.compactionRatio*float64(base)
+}
+
+// startCompaction merges the sources in the background. The caller must hold
+// db.mu.
+func (db *Db) startCompaction(filePath string, sources []*Segment, seq uint64) {
+	db.compaction.running = true
+	db.compaction.done = make(chan error, 1)
+	db.compaction.finished = make(chan struct{})
+	go func(done chan error, finished chan struct{}) {
+		started := time.Now()
+		reclaimed, err := db.compactOldSegments(filePath, sources, seq)
+
+		db.mu.Lock()
+		stats := &db.compaction.stats
+		stats.Runs++
+		stats.LastDuration = time.Since(started)
+		stats.LastFinished = time.Now()
+		stats.LastError = err
+		if err != nil {
+			stats.Failures++
+		} else {
+			stats.LastBytesReclaimed = reclaimed
+			stats.BytesReclaimed += reclaimed
+		}
+		db.compaction.running = false
+		db.mu.Unlock()
+		close(finished)
+		done <- err
+	}(db.compaction.done, db.compaction.finished)
+}
+
+// stopCompaction pauses compaction and waits for the running one to finish.
+// It returns whether compaction was paused already.
+func (db *Db) stopCompaction() bool {
+	db.mu.Lock()
+	paused := db.compaction.paused
+	db.compaction.paused = true
+	running, finished := db.compaction.running, db.compaction.finished
+	db.mu.Unlock()
+	if running {
+		<-finished
+	}
+	return paused
+}
@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 126, WithCompactionThreshold(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		db.Put(fmt.Sprintf("key%d", i%3), fmt.Sprintf("value%d", i))
+	}
+	assertEqual(t, db.CompactionStats().Runs, 0)
+
+	db.PauseCompaction()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	stats := db.CompactionStats()
+	assertEqual(t, stats.Runs, 1)
+	assertEqual(t, stats.Running, false)
+	assertEqual(t, stats.Paused, true)
+	if stats.BytesReclaimed <= 0 || stats.LastBytesReclaimed != stats.BytesReclaimed {
+		t.Errorf("Unexpected bytes reclaimed: %d, last %d", stats.BytesReclaimed, stats.LastBytesReclaimed)
+	}
+	if stats.LastDuration <= 0 {
+		t.Errorf("Unexpected duration: %s", stats.LastDuration)
+	}
+
+	assertSegmentsCount(t, db, 2)
+	if !segmentsOf(db)[0].isSorted() {
+		t.Error("Expected the segments to be compacted")
+	}
+	for i := 7; i < 10; i++ {
+		value, _ := db.Get(fmt.Sprintf("key%d", i%3))
+		assertEqual(t, value, fmt.Sprintf("value%d", i))
+	}
+}
+
+func TestDb_CompactionTriggers(t *testing.T) {
+	open := func(t *testing.T, opts ...Option) *Db {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		db, err := NewDb(dir, 126, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+
+	t.Run("paused", func(t *testing.T) {
+		db := open(t, WithCompactionThreshold(2))
+		db.PauseCompaction()
+		for i := 0; i < 10; i++ {
+			db.Put("key", fmt.Sprintf("value%d", i))
+		}
+		assertEqual(t, db.CompactionStats().Runs, 0)
+		if n := len(segmentsOf(db)); n < 3 {
+			t.Fatalf("Expected the segments to pile up, got %d", n)
+		}
+
+		db.ResumeCompaction()
+		checkTrigger(t, db, 1, func(sizes []int64, sorted bool) bool { return true })
+		assertSegmentsCount(t, db, 2)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		db := open(t, WithCompactionThreshold(100), WithCompactionBytes(300))
+		checkTrigger(t, db, 2, func(sizes []int64, sorted bool) bool {
+			var total int64
+			for _, size := range sizes {
+				total += size
+			}
+			return total >= 300
+		})
+	})
+
+	t.Run("ratio", func(t *testing.T) {
+		db := open(t, WithCompactionThreshold(100), WithCompactionRatio(2))
+		checkTrigger(t, db, 3, func(sizes []int64, sorted bool) bool {
+			if !sorted {
+				// Nothing is compacted yet, so two segments are enough.
+				return len(sizes) > 1
+			}
+			var fresh int64
+			for _, size := range sizes[1:] {
+				fresh += size
+			}
+			return len(sizes) > 1 && fresh >= 2*sizes[0]
+		})
+		value, _ := db.Get("key0")
+		assertEqual(t, value, "value")
+	})
+}
+
+// checkTrigger writes new keys until runs compactions have finished and
+// checks that every rollover started compaction only when fires returns true
+// for the sizes of the segments before it.
+func checkTrigger(t *testing.T, db *Db, runs int, fires func(sizes []int64, sorted bool) bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		stats := db.CompactionStats()
+		for stats.Running {
+			time.Sleep(10 * time.Millisecond)
+			stats = db.CompactionStats()
+		}
+		if stats.LastError != nil {
+			t.Fatal(stats.LastError)
+		}
+		if stats.Runs == runs {
+			return
+		}
+		segments := segmentsOf(db)
+		sizes := make([]int64, len(segments))
+		for j, s := range segments {
+			info, err := os.Stat(s.filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[j] = info.Size()
+		}
+
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+		after := db.CompactionStats()
+		started := after.Running || after.Runs > stats.Runs
+		rolledOver := started || len(segmentsOf(db)) > len(segments)
+		if rolledOver && started != fires(sizes, segments[0].isSorted()) {
+			t.Fatalf("Compaction started: %t, segment sizes: %v", started, sizes)
+		}
+	}
+	t.Fatalf("Expected %d compactions", runs)
+}
+
+func waitCompactions(t *testing.T, db *Db, runs int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := db.CompactionStats()
+		if stats.Runs >= runs && !stats.Running {
+			if stats.LastError != nil {
+				t.Fatal(stats.LastError)
+			}
+			assertEqual(t, stats.Runs, runs)
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d compactions, got %d", runs, stats.Runs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
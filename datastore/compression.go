@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression is the codec applied to the value of an entry. It's stored in
+// the entry header, so segments may mix compressed and plain entries.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone: "none",
+	CompressionGzip: "gzip",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(c))
+}
+
+// ParseCompression converts a codec name ("none" or "gzip") to Compression.
+func ParseCompression(name string) (Compression, error) {
+	for c, n := range compressionNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %q", name)
+}
+
+// WithCompression sets the codec applied to the values of new writes and of
+// plain entries rewritten by compaction. Existing entries stay readable
+// whatever the setting is.
+func WithCompression(c Compression) Option {
+	return func(db *Db) {
+		db.compression = c
+	}
+}
+
+// compress encodes the value of a put entry with c in place. The value is
+// kept as it is when compression doesn't make it shorter.
+func (e *entry) compress(c Compression) {
+	if c == CompressionNone || e.kind != kindPut || e.compression != CompressionNone {
+		return
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(w, e.value); err != nil {
+		return
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(e.value) {
+		return
+	}
+	e.value = buf.String()
+	e.compression = c
+}
+
+// decompress restores the original value of a compressed entry in place.
+func (e *entry) decompress() error {
+	switch e.compression {
+	case CompressionNone:
+		return nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader([]byte(e.value)))
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrCorrupted, err)
+		}
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrCorrupted, err)
+		}
+		e.value = string(value)
+		e.compression = CompressionNone
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown compression %d", ErrCorrupted, e.compression)
+	}
+}
@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	doc := `{"name": "value", "items": [` + strings.Repeat(`{"id": 1, "tags": ["a", "b"]},`, 50) + `]}`
+
+	db, err := NewDb(dir, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("plain", doc)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 2000, WithCompression(CompressionGzip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("put/get", func(t *testing.T) {
+		if err := db.Put("doc", doc); err != nil {
+			t.Fatal(err)
+		}
+		if db.outOffset >= int64(2*len(doc)) {
+			t.Errorf("Expected the value to be compressed, segment size is %d", db.outOffset)
+		}
+		value, err := db.Get("doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, doc)
+
+		value, _ = db.Get("plain")
+		assertEqual(t, value, doc)
+	})
+
+	t.Run("short values stay plain", func(t *testing.T) {
+		db.Put("short", "v")
+		e, err := db.get("short")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos, _ := db.getPos("short")
+		stored, err := pos.segment.getFromSegment(pos.position)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, stored.compression, CompressionNone)
+		assertEqual(t, e.value, "v")
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		if err := db.PutBatch(map[string]string{"b1": doc, "b2": "v"}); err != nil {
+			t.Fatal(err)
+		}
+		value, _ := db.Get("b1")
+		assertEqual(t, value, doc)
+	})
+
+	t.Run("compaction compresses plain entries", func(t *testing.T) {
+		// Random bytes don't compress, so they fill the segments up.
+		noise := make([]byte, 1500)
+		rand.New(rand.NewSource(1)).Read(noise)
+		for i := 0; i < 3; i++ {
+			db.PutBytes("noise", noise)
+		}
+		time.Sleep(2 * time.Second)
+
+		s := segmentsOf(db)[0]
+		if !s.isSorted() {
+			t.Fatal("Expected a compacted segment")
+		}
+		var found bool
+		err := s.scan(fileHeaderSize, func(e *entry, _ int64) bool {
+			if e.key == "plain" {
+				found = true
+				assertEqual(t, e.compression, CompressionGzip)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatal("Expected the plain key in the compacted segment")
+		}
+		value, _ := db.Get("plain")
+		assertEqual(t, value, doc)
+	})
+}
@@ -3,18 +3,35 @@ package datastore
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	outFileName = "current-data"
+	tmpSuffix   = ".tmp"
 	bufSize     = 8192
+
+	defaultCompactionThreshold = 3
+	defaultRetention           = 1
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound  = fmt.Errorf("record does not exist")
+	ErrConflict  = fmt.Errorf("value does not match the expected one")
+	ErrCorrupted = fmt.Errorf("corrupted record")
+	ErrClosed    = fmt.Errorf("database is closed")
+)
 
 type hashIndex map[string]int64
 
@@ -25,232 +42,703 @@ type Db struct {
 	dir              string
 	segmentSize      int64
 	lastSegmentIndex int
-	indexOps         chan IndexOp
-	keyPositions     chan *KeyPosition
-	putOps           chan entry
-	putDone          chan error
+	putOps           chan putOp
+
+	compactionThreshold int
+	compactionBytes     int64
+	compactionRatio     float64
+	durability          Durability
+	groupCommitInterval time.Duration
+	groupCommitWrites   int
+	compression         Compression
+	retention           int
+
+	// syncFile fsyncs the active segment for the writes waiting for it.
+	syncFile func(f *os.File) error
+
+	// removeMu keeps compaction from removing segment files while Snapshot
+	// links them.
+	removeMu sync.Mutex
 
+	// mu guards the segment list, the index of the active segment and
+	// outOffset. Lookups share it, so Gets proceed in parallel; the put
+	// goroutine and compaction take it exclusively for short updates.
+	mu       sync.RWMutex
 	index    hashIndex
 	segments []*Segment
+	// retired maps the numbers of the segments merged by compaction to their
+	// sizes, so ReadLog can tell whether a reader got to their end.
+	retired    map[int]int64
+	compaction compaction
+	// generation counts the changes of the segment list that removed
+	// segments, so a read failing on a removed file is repeated only after one.
+	generation uint64
+	closed     bool
+	// seq is the sequence number of the last write. Only the put goroutine
+	// changes it.
+	seq uint64
+
+	watchMu  sync.Mutex
+	watchers map[*Watcher]struct{}
+
+	puts atomic.Uint64
+	gets atomic.Uint64
 }
 
+// Segment is a data file with its index. Segments written by compaction keep
+// their keys sorted and have a sparse index instead of the full one.
 type Segment struct {
 	outOffset int64
 	index     hashIndex
+	sparse    *sparseIndex
 	filePath  string
+	number    int
+	// startSeq is the sequence number from the file header: no entry written
+	// before the file has a higher one.
+	startSeq uint64
+	// lastSeq is the highest sequence number of the entries in the file.
+	lastSeq uint64
+	// file is a read-only handle shared by all reads of the segment.
+	file *os.File
 }
 
-type IndexOp struct {
-	isWrite bool
-	key     string
-	index   int64
+// putOp is a write handled by the put goroutine. When prepare is set, it builds
+// the entry there, so reading the current value and writing the new one can't
+// interleave with other writes. When run is set, it's called instead of a
+// write once the pending writes are synced, e.g. to roll the segment over.
+type putOp struct {
+	entry   entry
+	prepare func() (entry, error)
+	run     func() error
+	done    chan error
+	// replicated keeps the sequence number the entry got in another Db.
+	replicated bool
 }
 
+// KeyPosition tells where to look for a key: the sorted segments that are
+// newer than the hash-indexed segment holding the key have to be checked first.
 type KeyPosition struct {
-	segment  *Segment
-	position int64
+	segment    *Segment
+	position   int64
+	sorted     []*Segment
+	generation uint64
 }
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
-	db := &Db{
-		dir:          dir,
-		segmentSize:  segmentSize,
-		segments:     make([]*Segment, 0),
-		indexOps:     make(chan IndexOp),
-		keyPositions: make(chan *KeyPosition),
-		putOps:       make(chan entry),
-		putDone:      make(chan error),
+// Option configures optional Db settings in NewDb.
+type Option func(db *Db)
+
+// WithCompactionThreshold sets the number of segments that triggers merging
+// of all the inactive ones.
+func WithCompactionThreshold(n int) Option {
+	return func(db *Db) {
+		db.compactionThreshold = n
 	}
+}
 
-	err := db.createSegment()
-	if err != nil {
-		return nil, err
+// WithRetention sets how many of the latest versions of every key compaction
+// keeps for GetAt and History. Older versions are also readable until their
+// segments are compacted.
+func WithRetention(n int) Option {
+	return func(db *Db) {
+		db.retention = n
+	}
+}
+
+func NewDb(dir string, segmentSize int64, opts ...Option) (*Db, error) {
+	db := &Db{
+		dir:                 dir,
+		segmentSize:         segmentSize,
+		compactionThreshold: defaultCompactionThreshold,
+		retention:           defaultRetention,
+		segments:            make([]*Segment, 0),
+		retired:             make(map[int]int64),
+		watchers:            make(map[*Watcher]struct{}),
+		putOps:              make(chan putOp),
+		groupCommitInterval: defaultGroupCommitInterval,
+		groupCommitWrites:   defaultGroupCommitWrites,
+		syncFile:            (*os.File).Sync,
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.compactionThreshold < 2 {
+		return nil, fmt.Errorf("compaction threshold must be at least 2, got %d", db.compactionThreshold)
+	}
+	if db.compactionBytes < 0 || db.compactionRatio < 0 {
+		return nil, fmt.Errorf("compaction triggers can't be negative")
+	}
+	if db.retention < 1 {
+		return nil, fmt.Errorf("retention must be at least 1 version, got %d", db.retention)
+	}
+	if db.durability == DurabilityGroupCommit && (db.groupCommitInterval <= 0 || db.groupCommitWrites <= 0) {
+		return nil, fmt.Errorf("group commit needs a positive interval and writes count")
 	}
 
-	err = db.recover()
-	if err != nil && err != io.EOF {
+	if err := db.recover(); err != nil {
 		return nil, err
 	}
-	db.startIndexRoutine()
+	if len(db.segments) == 0 {
+		if err := db.createSegment(); err != nil {
+			return nil, err
+		}
+	}
 	db.startPutRoutine()
 	return db, nil
 }
 
-func (db *Db) startIndexRoutine() {
-	go func() {
-		for {
-			op := <-db.indexOps
-			if op.isWrite {
-				db.setKey(op.key, op.index)
-			} else {
-				segment, position, err := db.getSegmentAndPosition(op.key)
-				if err != nil {
-					db.keyPositions <- nil
-				} else {
-					db.keyPositions <- &KeyPosition{
-						segment,
-						position,
-					}
-				}
-			}
-		}
-	}()
+func (db *Db) createSegment() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.addSegment()
 }
 
-func (db *Db) createSegment() error {
+// addSegment rolls the output over to a new segment and starts compaction when
+// a trigger fires. The caller must hold db.mu.
+func (db *Db) addSegment() error {
+	return db.rollOver(db.compactionDue())
+}
+
+// rollOver starts a new active segment and, if compact is set, merges all the
+// previous ones. The caller must hold db.mu.
+func (db *Db) rollOver(compact bool) error {
+	// The compacted segment gets its number before the new active one, so
+	// ordering segments by number on recovery keeps newer values on top.
+	var compactPath string
+	if compact {
+		compactPath = db.getNewFileName()
+	}
+
 	filePath := db.getNewFileName()
 	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0777)
 	if err != nil {
 		return err
 	}
+	if _, err := f.Write(newFileHeader(db.seq).Encode()); err != nil {
+		f.Close()
+		return err
+	}
 
 	newSegment := &Segment{
 		filePath: filePath,
+		number:   segmentNumber(filePath),
 		index:    make(hashIndex),
+		startSeq: db.seq,
+	}
+	if err := newSegment.open(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if db.durability != DurabilityNone {
+		if err := syncDir(db.dir); err != nil {
+			f.Close()
+			newSegment.close()
+			return err
+		}
 	}
 
+	if db.out != nil {
+		db.out.Close()
+	}
+	if len(db.segments) > 0 {
+		// The closed segment won't change anymore, so it gets a hint for the next start.
+		closed := db.getLastSegment()
+		closed.outOffset = db.outOffset
+		go closed.writeHint()
+	}
 	db.out = f
-	db.outOffset = 0
+	db.outOffset = fileHeaderSize
 	db.outPath = filePath
 	db.segments = append(db.segments, newSegment)
 
-	if len(db.segments) >= 3 {
-		go db.compactOldSegments()
+	if compactPath != "" {
+		sources := make([]*Segment, len(db.segments)-1)
+		copy(sources, db.segments)
+		db.startCompaction(compactPath, sources, db.seq)
 	}
 
 	return nil
 }
 
-func (db *Db) getPos(key string) *KeyPosition {
-	readOp := IndexOp{
-		isWrite: false,
-		key:     key,
+func (db *Db) getPos(key string) (*KeyPosition, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
 	}
-	db.indexOps <- readOp
-	return <-db.keyPositions
+	keyPos := db.getSegmentAndPosition(key)
+	if keyPos != nil {
+		keyPos.generation = db.generation
+	}
+	return keyPos, nil
 }
 
 func (db *Db) getNewFileName() string {
-	result := filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, db.lastSegmentIndex))
+	result := segmentPath(db.dir, db.lastSegmentIndex)
 	db.lastSegmentIndex++
 	return result
 }
 
-func (db *Db) compactOldSegments() {
-	filePath := db.getNewFileName()
+func segmentPath(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d", outFileName, n))
+}
+
+func segmentNumber(path string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), outFileName))
+	return n
+}
+
+// segmentNumbers returns the sorted numbers of the segment files among the directory entries.
+func segmentNumbers(files []os.DirEntry) []int {
+	var numbers []int
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), outFileName) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(f.Name(), outFileName))
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// compactOldSegments merges the sources into a single segment at filePath and
+// returns the bytes reclaimed; seq is at least the sequence number of their
+// latest entry.
+// The merged file is written under a temporary name and renamed only once it
+// is synced, and the sources are removed oldest first after the swap, so a
+// crash at any point leaves a consistent set of segments on disk.
+func (db *Db) compactOldSegments(filePath string, sources []*Segment, seq uint64) (int64, error) {
+	newSegment, err := writeCompacted(filePath, sources, seq, db.compression, db.retention)
+	if err != nil {
+		return 0, err
+	}
+
+	db.removeMu.Lock()
+	defer db.removeMu.Unlock()
+
+	db.mu.Lock()
+	swapped := db.replaceSegments(sources, newSegment)
+	if swapped {
+		for _, s := range sources {
+			db.retired[s.number] = s.outOffset
+		}
+	}
+	db.mu.Unlock()
+	if !swapped {
+		newSegment.close()
+		os.Remove(filePath)
+		os.Remove(hintPath(filePath))
+		return 0, errSegmentsChanged
+	}
+
+	reclaimed := -newSegment.outOffset
+	for _, s := range sources {
+		reclaimed += s.outOffset
+		// Reads still holding the segment fail with os.ErrClosed and look the key up again.
+		s.close()
+		os.Remove(s.filePath)
+		os.Remove(hintPath(s.filePath))
+	}
+	return reclaimed, nil
+}
+
+// writeCompacted merges the sources into a sorted segment, keeping up to
+// retention latest versions of every key. Keys that are deleted or expired
+// are dropped with all their versions. Compressed entries are copied as they
+// are, plain ones are compressed with c.
+func writeCompacted(filePath string, sources []*Segment, seq uint64, c Compression, retention int) (*Segment, error) {
+	keys := 0
+	for _, s := range sources {
+		keys += s.keyCount()
+	}
 	newSegment := &Segment{
 		filePath: filePath,
-		index:    make(hashIndex),
+		number:   segmentNumber(filePath),
+		sparse:   newSparseIndex(keys),
+		startSeq: seq,
 	}
-	var offset int64
+	offset := int64(fileHeaderSize)
 
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	tmpPath := filePath + tmpSuffix
+	f, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
-		return
+		return nil, err
 	}
+	defer os.Remove(tmpPath)
 	defer f.Close()
 
-	lastSegmentIndex := len(db.segments) - 2
-	for i := 0; i <= lastSegmentIndex; i++ {
-		s := db.segments[i]
-		for key, index := range s.index {
-			if i < lastSegmentIndex && checkKeyInSegments(db.segments[i+1:lastSegmentIndex+1], key) {
-				continue
-			}
+	hint, err := createHint(filePath)
+	if err != nil {
+		return nil, err
+	}
 
-			value, _ := s.getFromSegment(index)
-			e := entry{
-				key:   key,
-				value: value,
+	out := bufio.NewWriterSize(f, bufSize)
+	if _, err := out.Write(newFileHeader(seq).Encode()); err != nil {
+		hint.abort()
+		return nil, err
+	}
+	now := time.Now()
+	err = mergeSegments(sources, retention > 1, func(versions []*entry) error {
+		latest := versions[len(versions)-1]
+		if latest.isTombstone() || latest.isExpired(now) {
+			return nil
+		}
+		if len(versions) > retention {
+			versions = versions[len(versions)-retention:]
+		}
+		for _, e := range versions {
+			e.compress(c)
+			n, err := out.Write(e.Encode())
+			if err != nil {
+				return err
 			}
-
-			n, err := f.Write(e.Encode())
-			if err == nil {
-				newSegment.index[key] = offset
-				offset += int64(n)
+			newSegment.sparse.add(e.key, offset)
+			hint.add(keyOffset{
+				key:       e.key,
+				offset:    offset,
+				size:      int64(n),
+				seq:       e.seq,
+				kind:      e.kind,
+				expiresAt: e.expiresAt,
+			})
+			offset += int64(n)
+			if e.seq > newSegment.lastSeq {
+				newSegment.lastSeq = e.seq
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		hint.abort()
+		return nil, err
 	}
+	newSegment.outOffset = offset
 
-	db.segments = []*Segment{newSegment, db.getLastSegment()}
+	if err := out.Flush(); err != nil {
+		hint.abort()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		hint.abort()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		hint.abort()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		hint.abort()
+		return nil, err
+	}
+	// Without the hint the segment is still recovered by reading it whole.
+	_ = hint.finish(offset, true)
+	if err := syncDir(filepath.Dir(filePath)); err != nil {
+		return nil, err
+	}
+	return newSegment, newSegment.open()
 }
 
-func checkKeyInSegments(segments []*Segment, key string) bool {
-	for _, s := range segments {
-		if _, ok := s.index[key]; ok {
-			return true
+// replaceSegments puts the compacted segment in place of its sources. It fails
+// if the sources are no longer in the list, e.g. when another compaction has
+// already merged them.
+func (db *Db) replaceSegments(sources []*Segment, compacted *Segment) bool {
+	if len(db.segments) < len(sources) {
+		return false
+	}
+	for i, s := range sources {
+		if db.segments[i] != s {
+			return false
 		}
 	}
-	return false
+
+	segments := []*Segment{compacted}
+	db.segments = append(segments, db.segments[len(sources):]...)
+	db.generation++
+	return true
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 func (db *Db) recover() error {
-	var err error
-	var buf [bufSize]byte
-	in := bufio.NewReaderSize(db.out, bufSize)
-	for err == nil {
-		header, err := in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
+	files, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, outFileName) {
+			continue
+		}
+		if strings.HasSuffix(name, tmpSuffix) {
+			// Left by a compaction that didn't finish.
+			os.Remove(filepath.Join(db.dir, name))
+		}
+		if strings.HasSuffix(name, hintSuffix) {
+			// A hint outliving its segment, e.g. when compaction removed the
+			// segment while the hint was being written.
+			segment := filepath.Join(db.dir, strings.TrimSuffix(name, hintSuffix))
+			if _, err := os.Stat(segment); os.IsNotExist(err) {
+				os.Remove(filepath.Join(db.dir, name))
+			}
+		}
+	}
+
+	numbers := segmentNumbers(files)
+	for i, n := range numbers {
+		path := segmentPath(db.dir, n)
+		active := i == len(numbers)-1
+		if active {
+			if err := initEmptySegment(path, db.seq); err != nil {
 				return err
 			}
-		} else if err != nil {
+		}
+		segment, err := loadSegment(path, active)
+		if err != nil {
 			return err
 		}
-		size := binary.LittleEndian.Uint32(header)
-		var data []byte
+		db.seq = maxSeq(db.seq, segment.startSeq, segment.lastSeq)
+		db.segments = append(db.segments, segment)
+		db.lastSegmentIndex = n + 1
+	}
 
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
-		}
+	if len(db.segments) == 0 {
+		return nil
+	}
 
-		n, err := in.Read(data)
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
-			}
+	last := db.getLastSegment()
+	f, err := os.OpenFile(last.filePath, os.O_APPEND|os.O_RDWR, 0777)
+	if err != nil {
+		return err
+	}
+	db.out = f
+	db.outPath = last.filePath
+	db.outOffset = last.outOffset
+	return nil
+}
 
-			var e entry
-			e.Decode(data)
-			db.setKey(e.key, int64(n))
-		}
+// loadSegment opens the segment file at path and rebuilds its index; active
+// is set for the segment new writes are appended to.
+func loadSegment(path string, active bool) (*Segment, error) {
+	h, err := checkFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	segment := &Segment{
+		filePath: path,
+		number:   segmentNumber(path),
+		startSeq: h.seq,
+	}
+	offset, err := segment.recover(active)
+	if err != nil {
+		return nil, err
+	}
+	if err := segment.open(); err != nil {
+		return nil, err
+	}
+	segment.outOffset = offset
+	return segment, nil
+}
+
+// initEmptySegment writes the file header to an empty segment, which is what
+// a crash right after the segment was created leaves behind; seq is the last
+// sequence number found in the older segments.
+func initEmptySegment(path string, seq uint64) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > 0 {
+		return err
 	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0777)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(newFileHeader(seq).Encode())
 	return err
 }
 
 func (db *Db) Close() error {
+	db.watchMu.Lock()
+	watchers := make([]*Watcher, 0, len(db.watchers))
+	for w := range db.watchers {
+		watchers = append(watchers, w)
+	}
+	db.watchMu.Unlock()
+	for _, w := range watchers {
+		w.Stop()
+	}
+
+	db.mu.Lock()
+	db.closed = true
+	for _, s := range db.segments {
+		s.close()
+	}
+	db.mu.Unlock()
 	return db.out.Close()
 }
 
-func (db *Db) setKey(key string, n int64) {
-	db.getLastSegment().index[key] = db.outOffset
+func (db *Db) setKeys(keys []keyOffset, n int64, seq uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	segment := db.getLastSegment()
+	for _, k := range keys {
+		segment.index[k.key] = db.outOffset + k.offset
+	}
 	db.outOffset += n
+	db.seq = seq
 }
 
-func (db *Db) getSegmentAndPosition(key string) (*Segment, int64, error) {
+func (db *Db) getSegmentAndPosition(key string) *KeyPosition {
+	var sorted []*Segment
 	for i := range db.segments {
 		s := db.segments[len(db.segments)-i-1]
+		if s.isSorted() {
+			sorted = append(sorted, s)
+			continue
+		}
 		pos, ok := s.index[key]
 		if ok {
-			return s, pos, nil
+			return &KeyPosition{
+				segment:  s,
+				position: pos,
+				sorted:   sorted,
+			}
 		}
 	}
 
-	return nil, 0, ErrNotFound
+	if len(sorted) == 0 {
+		return nil
+	}
+	return &KeyPosition{sorted: sorted}
 }
 
-func (db *Db) Get(key string) (string, error) {
-	keyPos := db.getPos(key)
+func (db *Db) get(key string) (*entry, error) {
+	db.gets.Add(1)
+	e, err := db.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.isTombstone() || e.isExpired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	if err := e.decompress(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// lookup returns the newest entry of the key, which may be a tombstone or
+// expired, or nil if there's none. The value isn't decompressed.
+func (db *Db) lookup(key string) (*entry, error) {
+	keyPos, err := db.getPos(key)
 	if keyPos == nil {
-		return "", ErrNotFound
+		return nil, err
 	}
-	value, err := keyPos.segment.getFromSegment(keyPos.position)
+
+	segment, position := keyPos.segment, keyPos.position
+	for _, s := range keyPos.sorted {
+		pos, found, err := s.find(key)
+		if retry, err := db.readFailed(keyPos.generation, err); retry {
+			return db.lookup(key)
+		} else if err != nil {
+			return nil, err
+		}
+		if found {
+			segment, position = s, pos
+			break
+		}
+	}
+	if segment == nil {
+		return nil, nil
+	}
+
+	e, err := segment.getFromSegment(position)
+	if retry, err := db.readFailed(keyPos.generation, err); retry {
+		// The segment was compacted away after the lookup, so look again.
+		return db.lookup(key)
+	} else if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// isSegmentGone tells whether a read failed because compaction closed and
+// removed the segment after it was looked up.
+func isSegmentGone(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrClosed)
+}
+
+// readFailed tells whether a read over the segments of the given generation
+// that failed with err has to be repeated over the current segments, because
+// some of them were removed since. Otherwise it returns the error to report,
+// which is ErrClosed once the Db is closed.
+func (db *Db) readFailed(generation uint64, err error) (bool, error) {
+	if !isSegmentGone(err) {
+		return false, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return false, ErrClosed
+	}
+	if db.generation == generation {
+		return false, err
+	}
+	return true, nil
+}
+
+func (db *Db) Get(key string) (string, error) {
+	e, err := db.get(key)
 	if err != nil {
 		return "", err
 	}
-	return value, nil
+	if err := checkType(e, TypeString); err != nil {
+		return "", err
+	}
+	return e.value, nil
+}
+
+func (db *Db) GetInt64(key string) (int64, error) {
+	e, err := db.get(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkType(e, TypeInt64); err != nil {
+		return 0, err
+	}
+	return decodeInt64(e.value)
+}
+
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	e, err := db.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkType(e, TypeBytes); err != nil {
+		return nil, err
+	}
+	return []byte(e.value), nil
+}
+
+// Type returns the type of the value currently stored under the key.
+func (db *Db) Type(key string) (ValueType, error) {
+	e, err := db.get(key)
+	if err != nil {
+		return 0, err
+	}
+	return e.valueType, nil
 }
 
 func (db *Db) getLastSegment() *Segment {
@@ -259,61 +747,294 @@ func (db *Db) getLastSegment() *Segment {
 
 func (db *Db) startPutRoutine() {
 	go func() {
+		var group groupCommit
 		for {
-			entry := <-db.putOps
-			length := entry.getLength()
-
-			stat, err := db.out.Stat()
-			if err != nil {
-				db.putDone <- err
-				continue
-			}
-
-			if stat.Size()+length > db.segmentSize {
-				if err := db.createSegment(); err != nil {
-					db.putDone <- err
+			select {
+			case op := <-db.putOps:
+				if op.run != nil {
+					group.flush(db.syncOut)
+					op.done <- op.run()
+					continue
+				}
+				if err := db.write(op, &group); err != nil {
+					op.done <- err
 					continue
 				}
-			}
 
-			n, err := db.out.Write(entry.Encode())
-			if err == nil {
-				db.indexOps <- IndexOp{
-					isWrite: true,
-					key:     entry.key,
-					index:   int64(n),
+				switch db.durability {
+				case DurabilitySync:
+					op.done <- db.syncOut()
+				case DurabilityGroupCommit:
+					group.add(op.done, db.groupCommitInterval)
+					if len(group.pending) >= db.groupCommitWrites {
+						group.flush(db.syncOut)
+					}
+				default:
+					op.done <- nil
 				}
+			case <-group.timeout:
+				group.flush(db.syncOut)
 			}
-			db.putDone <- nil
 		}
 	}()
 }
 
-func (db *Db) Put(key, value string) error {
-	entry := entry{
-		key:   key,
-		value: value,
+func (db *Db) write(op putOp, group *groupCommit) error {
+	entry := op.entry
+	if op.prepare != nil {
+		var err error
+		if entry, err = op.prepare(); err != nil {
+			return err
+		}
+	}
+	length := entry.getLength()
+
+	stat, err := db.out.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size()+length > db.segmentSize {
+		// Writes waiting for a group commit must be synced before their file is closed.
+		group.flush(db.syncOut)
+		if err := db.createSegment(); err != nil {
+			return err
+		}
+	}
+
+	if !op.replicated {
+		entry.setSeq(db.seq + 1)
+	}
+	n, err := db.out.Write(entry.Encode())
+	if err == nil {
+		db.setKeys(entry.keyOffsets(), int64(n), maxSeq(db.seq, entry.seq))
+		db.publish(entry)
+		db.puts.Add(1)
 	}
-	db.putOps <- entry
-	return <-db.putDone
+	return err
+}
+
+func (db *Db) submit(op putOp) error {
+	op.done = make(chan error, 1)
+	db.putOps <- op
+	return <-op.done
 }
 
-func (s *Segment) getFromSegment(position int64) (string, error) {
-	file, err := os.Open(s.filePath)
+func (db *Db) put(e entry) error {
+	e.compress(db.compression)
+	return db.submit(putOp{entry: e})
+}
+
+// CompareAndSwap sets the key to the new value only if it currently holds the
+// expected one, otherwise ErrConflict is returned.
+func (db *Db) CompareAndSwap(key, expected, new string) error {
+	return db.submit(putOp{prepare: func() (entry, error) {
+		current, err := db.Get(key)
+		if err != nil {
+			return entry{}, err
+		}
+		if current != expected {
+			return entry{}, ErrConflict
+		}
+		e := entry{
+			key:       key,
+			value:     new,
+			valueType: TypeString,
+		}
+		e.compress(db.compression)
+		return e, nil
+	}})
+}
+
+// Increment adds delta to the int64 value of the key, treating a missing key
+// as zero, and returns the new value.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	var result int64
+	err := db.submit(putOp{prepare: func() (entry, error) {
+		current, err := db.GetInt64(key)
+		if err != nil && err != ErrNotFound {
+			return entry{}, err
+		}
+		result = current + delta
+		return entry{
+			key:       key,
+			value:     encodeInt64(result),
+			valueType: TypeInt64,
+		}, nil
+	}})
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	return result, nil
+}
+
+func (db *Db) Put(key, value string) error {
+	return db.put(entry{
+		key:       key,
+		value:     value,
+		valueType: TypeString,
+	})
+}
+
+// PutWithTTL writes a value that is treated as deleted once ttl passes.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	return db.put(entry{
+		key:       key,
+		value:     value,
+		valueType: TypeString,
+		expiresAt: time.Now().Add(ttl).UnixNano(),
+	})
+}
+
+func (db *Db) PutInt64(key string, value int64) error {
+	return db.put(entry{
+		key:       key,
+		value:     encodeInt64(value),
+		valueType: TypeInt64,
+	})
+}
+
+func (db *Db) PutBytes(key string, value []byte) error {
+	return db.put(entry{
+		key:       key,
+		value:     string(value),
+		valueType: TypeBytes,
+	})
+}
+
+// PutBatch writes all the pairs as a single record, so after a crash either
+// every pair of the batch is recovered or none of them.
+func (db *Db) PutBatch(pairs map[string]string) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	entries := make([]entry, len(keys))
+	for i, key := range keys {
+		e := entry{
+			key:       key,
+			value:     pairs[key],
+			valueType: TypeString,
+		}
+		e.compress(db.compression)
+		entries[i] = e
+	}
+	return db.put(newBatchEntry(entries))
+}
+
+func (db *Db) Delete(key string) error {
+	return db.put(entry{
+		key:  key,
+		kind: kindDelete,
+	})
+}
+
+// recover rebuilds the full index and finds the last sequence number of the
+// segment, from its hint file when there's a valid one. It returns the size
+// of the valid data in the file.
+func (s *Segment) recover(active bool) (int64, error) {
+	// The active segment is always read whole: writes are appended to it, so
+	// it needs the full index.
+	if !active {
+		if size, err := s.loadHint(); err == nil {
+			return size, nil
+		}
 	}
-	defer file.Close()
+	s.index = make(hashIndex)
+	return s.walk(func(k keyOffset) {
+		s.index[k.key] = k.offset
+		if k.seq > s.lastSeq {
+			s.lastSeq = k.seq
+		}
+	})
+}
 
-	_, err = file.Seek(position, 0)
+// walk reads all the records of the segment file and calls fn for every key
+// written, with its absolute offset.
+func (s *Segment) walk(fn func(k keyOffset)) (int64, error) {
+	f, err := os.Open(s.filePath)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
+	defer f.Close()
 
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+	offset := int64(fileHeaderSize)
+	var buf [bufSize]byte
+	in := bufio.NewReaderSize(f, bufSize)
+	if _, err := in.Discard(fileHeaderSize); err != nil {
+		return 0, s.corrupted(0)
+	}
+	for {
+		header, err := in.Peek(headerSize)
+		if err == io.EOF && len(header) == 0 {
+			return offset, nil
+		} else if err == io.EOF {
+			return offset, s.corrupted(offset)
+		} else if err != nil {
+			return offset, err
+		}
+		size := binary.LittleEndian.Uint32(header)
+		if !validRecordSize(header) {
+			return offset, s.corrupted(offset)
+		}
+		var data []byte
+
+		if size < bufSize {
+			data = buf[:size]
+		} else {
+			data = make([]byte, size)
+		}
+
+		n, err := io.ReadFull(in, data)
+		if err != nil {
+			return offset, s.corrupted(offset)
+		}
+
+		var e entry
+		e.Decode(data)
+		if e.kind == kindBatch && verifySum(data) != nil {
+			// A damaged batch is dropped as a whole.
+			offset += int64(n)
+			continue
+		}
+		for _, k := range e.keyOffsets() {
+			k.offset += offset
+			fn(k)
+		}
+		offset += int64(n)
+	}
+}
+
+func (s *Segment) corrupted(offset int64) error {
+	return fmt.Errorf("%s: %w at offset %d, run fsck to repair", s.filePath, ErrCorrupted, offset)
+}
+
+func (s *Segment) open() error {
+	f, err := os.Open(s.filePath)
 	if err != nil {
-		return "", err
+		return err
+	}
+	s.file = f
+	return nil
+}
+
+func (s *Segment) close() {
+	if s.file != nil {
+		s.file.Close()
 	}
-	return value, nil
+}
+
+// reader returns a reader of the segment from offset that doesn't affect other reads.
+func (s *Segment) reader(offset int64) io.Reader {
+	return io.NewSectionReader(s.file, offset, math.MaxInt64-offset)
+}
+
+func (s *Segment) getFromSegment(position int64) (*entry, error) {
+	return readEntryAt(s.file, position)
 }
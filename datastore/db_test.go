@@ -1,10 +1,16 @@
 package datastore
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -67,9 +73,10 @@ func TestDb_Put(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		size1 := outInfo.Size() / 2
-		if size1*2 != outInfo.Size() {
-			t.Errorf("Unexpected size (%d vs %d)", size1, outInfo.Size())
+		dataSize := outInfo.Size() - fileHeaderSize
+		size1 := dataSize / 2
+		if size1*2 != dataSize {
+			t.Errorf("Unexpected size (%d vs %d)", size1, dataSize)
 		}
 	})
 
@@ -106,7 +113,7 @@ func TestDb_Segmentation(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	db, err := NewDb(dir, 85)
+	db, err := NewDb(dir, 126)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,20 +139,462 @@ func TestDb_Segmentation(t *testing.T) {
 	})
 
 	t.Run("shouldn't store duplicates", func(t *testing.T) {
-		file, err := os.Open(db.segments[0].filePath)
+		file, err := os.Open(segmentsOf(db)[0].filePath)
 		defer file.Close()
 
 		if err != nil {
 			t.Error(err)
 		}
 		inf, _ := file.Stat()
-		assertFileSize(t, inf, 126)
+		assertFileSize(t, inf, 205)
 	})
 
 	t.Run("shouldn't store new values of duplicate keys", func(t *testing.T) {
 		value, _ := db.Get("key2")
 		assertEqual(t, value, "value5")
 	})
+
+	t.Run("should remove merged files", func(t *testing.T) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		assertEqual(t, strings.Join(names, ","), outFileName+"2,"+outFileName+"2"+hintSuffix+","+outFileName+"3")
+	})
+}
+
+func TestDb_CompactionLeftovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A compaction that crashed before renaming its output.
+	tmpPath := filepath.Join(dir, outFileName+"1"+tmpSuffix)
+	if err := ioutil.WriteFile(tmpPath, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary file to be removed, got: %v", err)
+	}
+	value, _ := db.Get("key1")
+	assertEqual(t, value, "value1")
+}
+
+func TestDb_Recover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 126)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key3", "value3")
+	db.Put("key2", "value5")
+	db.Put("key4", "value4")
+
+	time.Sleep(2 * time.Second)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 126)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("restores all segments", func(t *testing.T) {
+		expected := map[string]string{
+			"key1": "value1",
+			"key2": "value5",
+			"key3": "value3",
+			"key4": "value4",
+		}
+		for key, value := range expected {
+			got, err := db.Get(key)
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", key, err)
+			}
+			assertEqual(t, got, value)
+		}
+	})
+
+	t.Run("appends to the newest segment", func(t *testing.T) {
+		outPath := db.outPath
+		db.Put("key5", "value5")
+
+		assertEqual(t, db.outPath, outPath)
+		assertEqual(t, db.outPath, filepath.Join(dir, outFileName+"3"))
+		value, _ := db.Get("key5")
+		assertEqual(t, value, "value5")
+	})
+}
+
+func TestDb_CompactionThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewDb(dir, 126, WithCompactionThreshold(1)); err == nil {
+		t.Error("Expected an error for compaction threshold below 2")
+	}
+
+	db, err := NewDb(dir, 126, WithCompactionThreshold(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key3", "value3")
+	db.Put("key4", "value4")
+	db.Put("key5", "value5")
+
+	time.Sleep(2 * time.Second)
+	assertSegmentsCount(t, db, 3)
+
+	db.Put("key6", "value6")
+	db.Put("key7", "value7")
+
+	time.Sleep(2 * time.Second)
+	assertSegmentsCount(t, db, 2)
+}
+
+func TestDb_TypedValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("int64", func(t *testing.T) {
+		if err := db.PutInt64("counter", -42); err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.GetInt64("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, int64(-42))
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		blob := []byte{0, 1, 2, 0xff}
+		if err := db.PutBytes("blob", blob); err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.GetBytes("blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, string(value), string(blob))
+
+		valueType, _ := db.Type("blob")
+		assertEqual(t, valueType, TypeBytes)
+	})
+
+	t.Run("type mismatch", func(t *testing.T) {
+		db.Put("name", "value")
+
+		if _, err := db.Get("counter"); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("Expected type mismatch, got: %v", err)
+		}
+		if _, err := db.GetInt64("name"); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("Expected type mismatch, got: %v", err)
+		}
+	})
+}
+
+func TestDb_PutBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("other", "value")
+	batch := map[string]string{
+		"key1": "value1",
+		"key2": "value2",
+		"key3": "value3",
+	}
+
+	t.Run("put/get", func(t *testing.T) {
+		if err := db.PutBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+		for key, expected := range batch {
+			value, err := db.Get(key)
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", key, err)
+			}
+			assertEqual(t, value, expected)
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, expected := range batch {
+			value, _ := db.Get(key)
+			assertEqual(t, value, expected)
+		}
+	})
+
+	t.Run("damaged batch is dropped", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.OpenFile(db.outPath, os.O_RDWR, 0o655)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := entry{key: "other", value: "value"}
+		_, err = file.WriteAt([]byte{0x59}, int64(len(other.Encode())+headerSize+20))
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = NewDb(dir, 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for key := range batch {
+			_, err := db.Get(key)
+			assertEqual(t, err, ErrNotFound)
+		}
+		value, _ := db.Get("other")
+		assertEqual(t, value, "value")
+	})
+}
+
+func TestDb_CompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key", "value1")
+
+	if err := db.CompareAndSwap("key", "value1", "value2"); err != nil {
+		t.Errorf("Cannot swap value: %s", err)
+	}
+	if err := db.CompareAndSwap("key", "value1", "value3"); err != ErrConflict {
+		t.Errorf("Expected conflict, got: %v", err)
+	}
+	if err := db.CompareAndSwap("missing", "", "value"); err != ErrNotFound {
+		t.Errorf("Expected not found, got: %v", err)
+	}
+
+	value, _ := db.Get("key")
+	assertEqual(t, value, "value2")
+}
+
+func TestDb_Increment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.Increment("counter", 2); err != nil {
+				t.Errorf("Cannot increment: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, _ := db.GetInt64("counter")
+	assertEqual(t, value, int64(100))
+
+	db.Put("name", "value")
+	if _, err := db.Increment("name", 1); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected type mismatch, got: %v", err)
+	}
+}
+
+func TestDb_Durability(t *testing.T) {
+	const writes = 10
+	modes := map[string]struct {
+		opts  []Option
+		syncs int64
+	}{
+		"none": {opts: []Option{WithDurability(DurabilityNone)}, syncs: 0},
+		"sync": {opts: []Option{WithDurability(DurabilitySync)}, syncs: writes},
+		// All the concurrent writes are acknowledged by a single fsync.
+		"group": {opts: []Option{WithGroupCommit(time.Second, writes)}, syncs: 1},
+	}
+
+	for name, mode := range modes {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// Large enough for all the writes, so there's no rollover.
+			db, err := NewDb(dir, 1000, mode.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			var syncs atomic.Int64
+			db.syncFile = func(f *os.File) error {
+				syncs.Add(1)
+				return f.Sync()
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < writes; i++ {
+				key := fmt.Sprintf("key%d", i)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := db.Put(key, "value"); err != nil {
+						t.Errorf("Cannot put %s: %s", key, err)
+					}
+				}()
+			}
+			wg.Wait()
+			assertEqual(t, syncs.Load(), mode.syncs)
+
+			for i := 0; i < writes; i++ {
+				value, err := db.Get(fmt.Sprintf("key%d", i))
+				if err != nil {
+					t.Errorf("Cannot get key%d: %s", i, err)
+				}
+				assertEqual(t, value, "value")
+			}
+		})
+	}
+
+	t.Run("parse", func(t *testing.T) {
+		d, err := ParseDurability("group")
+		assertEqual(t, err, nil)
+		assertEqual(t, d, DurabilityGroupCommit)
+		if _, err := ParseDurability("always"); err == nil {
+			t.Error("Expected an error for unknown mode")
+		}
+	})
+}
+
+func TestDb_TTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 126)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("expires", func(t *testing.T) {
+		if err := db.PutWithTTL("session", "value", 100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		db.Put("key1", "value1")
+
+		value, err := db.Get("session")
+		if err != nil {
+			t.Errorf("Cannot get session: %s", err)
+		}
+		assertEqual(t, value, "value")
+
+		time.Sleep(150 * time.Millisecond)
+
+		_, err = db.Get("session")
+		assertEqual(t, err, ErrNotFound)
+	})
+
+	t.Run("compaction drops expired key", func(t *testing.T) {
+		db.Put("key2", "value2")
+		db.Put("key3", "value3")
+		db.Put("key4", "value4")
+
+		time.Sleep(2 * time.Second)
+
+		assertSegmentsCount(t, db, 2)
+		if _, ok, _ := segmentsOf(db)[0].find("session"); ok {
+			t.Error("Expected expired key to be dropped by compaction")
+		}
+		value, _ := db.Get("key1")
+		assertEqual(t, value, "value1")
+	})
 }
 
 func TestDb_Checksum(t *testing.T) {
@@ -155,7 +604,7 @@ func TestDb_Checksum(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	db, err := NewDb(dir, 85)
+	db, err := NewDb(dir, 126)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -175,7 +624,7 @@ func TestDb_Checksum(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = file.WriteAt([]byte{0x59}, int64(3))
+	_, err = file.WriteAt([]byte{0x59}, fileHeaderSize+3)
 	if err != nil {
 		file.Close()
 		t.Fatal(err)
@@ -190,10 +639,263 @@ func TestDb_Checksum(t *testing.T) {
 	})
 }
 
+func TestDb_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 126)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("get after delete", func(t *testing.T) {
+		db.Put("key1", "value1")
+		db.Put("key2", "value2")
+		if err := db.Delete("key1"); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := db.Get("key1")
+		assertEqual(t, err, ErrNotFound)
+		value, _ := db.Get("key2")
+		assertEqual(t, value, "value2")
+	})
+
+	t.Run("compaction drops deleted key", func(t *testing.T) {
+		db.Put("key3", "value3")
+		db.Put("key4", "value4")
+
+		time.Sleep(2 * time.Second)
+
+		assertSegmentsCount(t, db, 2)
+		if _, ok, _ := segmentsOf(db)[0].find("key1"); ok {
+			t.Error("Expected deleted key to be dropped by compaction")
+		}
+		_, err := db.Get("key1")
+		assertEqual(t, err, ErrNotFound)
+	})
+
+}
+
+func TestDb_DeleteRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Get("key1")
+	assertEqual(t, err, ErrNotFound)
+	value, _ := db.Get("key2")
+	assertEqual(t, value, "value2")
+}
+
+// TestDb_ConcurrentAccess reads while segments roll over and get compacted;
+// run it with -race.
+func TestDb_ReadAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 126, WithCompactionThreshold(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key2", "value2")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"key1", "key2", "missing"} {
+		if _, err := db.Get(key); err != ErrClosed {
+			t.Errorf("Expected ErrClosed for %s, got: %v", key, err)
+		}
+	}
+	it := db.Scan("")
+	if it.Next() || it.Err() != ErrClosed {
+		t.Errorf("Expected ErrClosed from Scan, got: %v", it.Err())
+	}
+	if _, err := db.History("key1", 0); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from History, got: %v", err)
+	}
+	if _, _, _, err := db.ReadLog(LogPosition{}, 100); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from ReadLog, got: %v", err)
+	}
+	if _, err := db.Stats(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from Stats, got: %v", err)
+	}
+}
+
+func TestDb_ConcurrentAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const writers, readers, rounds = 4, 8, 200
+	for w := 0; w < writers; w++ {
+		db.Put(fmt.Sprintf("key%d", w), "0")
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", w)
+			for i := 1; i <= rounds; i++ {
+				if err := db.Put(key, fmt.Sprint(i)); err != nil {
+					t.Errorf("Cannot put %s: %s", key, err)
+					return
+				}
+				db.Put(fmt.Sprintf("tmp%d", w), "value")
+				db.Delete(fmt.Sprintf("tmp%d", w))
+			}
+		}(w)
+	}
+
+	var readersWg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readersWg.Add(1)
+		go func(r int) {
+			defer readersWg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%d", r%writers)
+				if _, err := db.Get(key); err != nil {
+					t.Errorf("Cannot get %s: %s", key, err)
+					return
+				}
+				it := db.Scan("key")
+				for it.Next() {
+				}
+				if err := it.Err(); err != nil {
+					t.Errorf("Cannot scan: %s", err)
+					return
+				}
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(stop)
+	readersWg.Wait()
+
+	for w := 0; w < writers; w++ {
+		value, err := db.Get(fmt.Sprintf("key%d", w))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, fmt.Sprint(rounds))
+	}
+}
+
+// BenchmarkDb_Get compares reads through the shared segment handles with
+// opening the segment file for every read, as Get used to do.
+func BenchmarkDb_Get(b *testing.B) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("shared handle", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, err := db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+
+	b.Run("reopen per read", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				keyPos, _ := db.getPos(fmt.Sprintf("key%d", i%keys))
+				file, err := os.Open(keyPos.segment.filePath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := file.Seek(keyPos.position, 0); err != nil {
+					b.Fatal(err)
+				}
+				_, err = readEntry(bufio.NewReader(file))
+				file.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
+
+// segmentsOf copies the segment list, which compaction may swap concurrently.
+func segmentsOf(db *Db) []*Segment {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return append([]*Segment(nil), db.segments...)
+}
+
 func assertSegmentsCount(t *testing.T, db *Db, expectedCount int) {
 	t.Helper()
-	if len(db.segments) != expectedCount {
-		t.Errorf("Something went wrong with segmentation. Expected %d files, got %d", expectedCount, len(db.segments))
+	if n := len(segmentsOf(db)); n != expectedCount {
+		t.Errorf("Something went wrong with segmentation. Expected %d files, got %d", expectedCount, n)
 	}
 }
 
@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// Durability tells when Put fsyncs the segment file before returning.
+type Durability int
+
+const (
+	// DurabilityNone returns as soon as the write reaches the OS.
+	DurabilityNone Durability = iota
+	// DurabilitySync fsyncs after every write.
+	DurabilitySync
+	// DurabilityGroupCommit fsyncs once per group of writes and acknowledges
+	// all of them together.
+	DurabilityGroupCommit
+)
+
+const (
+	defaultGroupCommitInterval = 10 * time.Millisecond
+	defaultGroupCommitWrites   = 64
+)
+
+var durabilityNames = map[Durability]string{
+	DurabilityNone:        "none",
+	DurabilitySync:        "sync",
+	DurabilityGroupCommit: "group",
+}
+
+func (d Durability) String() string {
+	if name, ok := durabilityNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(d))
+}
+
+// ParseDurability converts a mode name ("none", "sync" or "group") to Durability.
+func ParseDurability(name string) (Durability, error) {
+	for d, n := range durabilityNames {
+		if n == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown durability mode %q", name)
+}
+
+// WithDurability sets the fsync mode used by writes.
+func WithDurability(d Durability) Option {
+	return func(db *Db) {
+		db.durability = d
+	}
+}
+
+// WithGroupCommit enables group commit: the segment is synced when the oldest
+// unsynced write is interval old or when `writes` writes are unsynced.
+func WithGroupCommit(interval time.Duration, writes int) Option {
+	return func(db *Db) {
+		db.durability = DurabilityGroupCommit
+		db.groupCommitInterval = interval
+		db.groupCommitWrites = writes
+	}
+}
+
+// syncOut fsyncs the active segment. Only the put goroutine calls it.
+func (db *Db) syncOut() error {
+	return db.syncFile(db.out)
+}
+
+// groupCommit collects acknowledgements of writes waiting for the next fsync.
+// It's used only by the put goroutine.
+type groupCommit struct {
+	pending []chan error
+	timer   *time.Timer
+	timeout <-chan time.Time
+}
+
+func (g *groupCommit) add(done chan error, interval time.Duration) {
+	g.pending = append(g.pending, done)
+	if g.timer == nil {
+		g.timer = time.NewTimer(interval)
+		g.timeout = g.timer.C
+	}
+}
+
+// flush syncs the output file and acknowledges all the pending writes.
+func (g *groupCommit) flush(sync func() error) {
+	if len(g.pending) == 0 {
+		return
+	}
+	err := sync()
+	for _, done := range g.pending {
+		done <- err
+	}
+	g.pending = nil
+	g.timer.Stop()
+	g.timer = nil
+	g.timeout = nil
+}
@@ -7,32 +7,153 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	headerSize = 31
+	sumSize    = sha1.Size
+)
+
+const (
+	kindPut byte = iota
+	kindDelete
+	// kindBatch entries carry several encoded entries as their value, so the
+	// whole batch is covered by a single checksum.
+	kindBatch
 )
 
 type entry struct {
-	key   string
-	value string
-	sum   []byte
+	key       string
+	value     string
+	kind      byte
+	valueType ValueType
+	// expiresAt is a Unix time in nanoseconds after which the entry is treated
+	// as deleted; zero means it never expires.
+	expiresAt   int64
+	compression Compression
+	// seq is the sequence number of the write, which grows with every write
+	// to the Db. The entries of a batch share the sequence number of the batch.
+	seq uint64
+	sum []byte
 }
 
 func (e *entry) getLength() int64 {
-	return int64(len(e.key) + len(e.value) + 12)
+	return int64(len(e.key) + len(e.value) + headerSize)
+}
+
+// size returns the length of the encoded entry.
+func (e *entry) size() int64 {
+	return int64(len(e.key) + len(e.value) + headerSize + sumSize)
+}
+
+func (e *entry) isTombstone() bool {
+	return e.kind == kindDelete
+}
+
+// keyOffset is the position and the size of a key's entry relative to the
+// start of the record holding it.
+type keyOffset struct {
+	key    string
+	offset int64
+	size   int64
+	seq    uint64
+	// kind and expiresAt tell whether the entry deletes the key or expires.
+	kind      byte
+	expiresAt int64
+}
+
+// isLive reports whether the entry holds a value that hasn't expired.
+func (k keyOffset) isLive(now time.Time) bool {
+	return k.kind != kindDelete && (k.expiresAt == 0 || now.UnixNano() < k.expiresAt)
+}
+
+func newBatchEntry(entries []entry) entry {
+	var value []byte
+	for _, e := range entries {
+		value = append(value, e.Encode()...)
+	}
+	return entry{
+		value: string(value),
+		kind:  kindBatch,
+	}
+}
+
+// keyOffsets lists the keys written by the record together with their offsets.
+func (e *entry) keyOffsets() []keyOffset {
+	if e.kind != kindBatch {
+		return []keyOffset{{key: e.key, offset: 0, size: e.size(), seq: e.seq, kind: e.kind, expiresAt: e.expiresAt}}
+	}
+
+	var res []keyOffset
+	data := []byte(e.value)
+	base := int64(headerSize + len(e.key))
+	for pos := 0; pos < len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos:]))
+		var inner entry
+		inner.Decode(data[pos : pos+size])
+		res = append(res, keyOffset{
+			key:       inner.key,
+			offset:    base + int64(pos),
+			size:      int64(size),
+			seq:       e.seq,
+			kind:      inner.kind,
+			expiresAt: inner.expiresAt,
+		})
+		pos += size
+	}
+	return res
+}
+
+// batchEntries decodes the entries carried by a batch.
+func (e *entry) batchEntries() []entry {
+	var res []entry
+	data := []byte(e.value)
+	for pos := 0; pos < len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos:]))
+		var inner entry
+		inner.Decode(data[pos : pos+size])
+		res = append(res, inner)
+		pos += size
+	}
+	return res
+}
+
+// setSeq assigns the sequence number to the entry and to the entries of a batch.
+func (e *entry) setSeq(seq uint64) {
+	e.seq = seq
+	if e.kind != kindBatch {
+		return
+	}
+	inner := e.batchEntries()
+	for i := range inner {
+		inner[i].seq = seq
+	}
+	e.value = newBatchEntry(inner).value
+}
+
+func (e *entry) isExpired(now time.Time) bool {
+	return e.expiresAt != 0 && now.UnixNano() >= e.expiresAt
 }
 
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	size := kl + vl + 32
+	size := kl + vl + headerSize + sumSize
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	binary.LittleEndian.PutUint32(res[8:], uint32(vl))
-	copy(res[12:], e.key)
-	copy(res[kl+12:], e.value)
-	data := make([]byte, size-20)
-	copy(data, res[:size-19])
-	sum := sha1.Sum(data)
-	copy(res[size-20:], sum[:])
+	res[12] = e.kind
+	res[13] = byte(e.valueType)
+	binary.LittleEndian.PutUint64(res[14:], uint64(e.expiresAt))
+	res[22] = byte(e.compression)
+	binary.LittleEndian.PutUint64(res[23:], e.seq)
+	copy(res[headerSize:], e.key)
+	copy(res[kl+headerSize:], e.value)
+	sum := sha1.Sum(res[:size-sumSize])
+	copy(res[size-sumSize:], sum[:])
 
 	return res
 }
@@ -40,57 +161,102 @@ func (e *entry) Encode() []byte {
 func (e *entry) Decode(input []byte) {
 	kl := binary.LittleEndian.Uint32(input[4:])
 	keyBuffer := make([]byte, kl)
-	copy(keyBuffer, input[12:kl+12])
+	copy(keyBuffer, input[headerSize:kl+headerSize])
 	e.key = string(keyBuffer)
 
 	vl := binary.LittleEndian.Uint32(input[8:])
 	valueBuffer := make([]byte, vl)
-	copy(valueBuffer, input[kl+12:kl+12+vl])
+	copy(valueBuffer, input[kl+headerSize:kl+headerSize+vl])
 	e.value = string(valueBuffer)
-	e.sum = make([]byte, 20)
-	copy(e.sum, input[kl+vl+12:])
+	e.kind = input[12]
+	e.valueType = ValueType(input[13])
+	e.expiresAt = int64(binary.LittleEndian.Uint64(input[14:]))
+	e.compression = Compression(input[22])
+	e.seq = binary.LittleEndian.Uint64(input[23:])
+	e.sum = make([]byte, sumSize)
+	copy(e.sum, input[kl+vl+headerSize:])
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	n := 12
-	header, err := in.Peek(n)
+func readEntry(in *bufio.Reader) (*entry, error) {
+	header, err := in.Peek(headerSize)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	keySize := int(binary.LittleEndian.Uint32(header[4:]))
 	valueSize := int(binary.LittleEndian.Uint32(header[8:]))
+	size := headerSize + keySize + valueSize + sumSize
 
-	data, err := in.Peek(n + keySize + valueSize)
+	data := make([]byte, size)
+	n, err := io.ReadFull(in, data)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("cannot read value")
 	}
 
-	_, err = in.Discard(n + keySize)
-	if err != nil {
-		return "", err
+	if err := verifySum(data); err != nil {
+		return nil, err
 	}
 
-	valueData, err := in.Peek(valueSize)
-	if err != nil {
-		return "", err
+	var e entry
+	e.Decode(data)
+	return &e, nil
+}
+
+// validRecordSize checks that the size in the record header matches its key and value lengths.
+func validRecordSize(header []byte) bool {
+	return validRecordSizeFor(header, headerSize)
+}
+
+// validRecordSizeFor is validRecordSize for an entry header of the given size,
+// which is smaller in the legacy format.
+func validRecordSizeFor(header []byte, entryHeaderSize int) bool {
+	size := uint64(binary.LittleEndian.Uint32(header))
+	kl := uint64(binary.LittleEndian.Uint32(header[4:]))
+	vl := uint64(binary.LittleEndian.Uint32(header[8:]))
+	return size == kl+vl+uint64(entryHeaderSize)+sumSize
+}
+
+func verifySum(data []byte) error {
+	size := len(data)
+	if size < sumSize {
+		return errors.New("record is too short")
 	}
-	if len(valueData) != valueSize {
-		return "", fmt.Errorf("cannot read value")
+	realSum := sha1.Sum(data[:size-sumSize])
+	if !bytes.Equal(data[size-sumSize:], realSum[:]) {
+		return errors.New("sha1 sum mismatch")
 	}
+	return nil
+}
 
-	_, err = in.Discard(valueSize)
-	if err != nil {
-		return "", err
+// readEntryAt reads the entry at pos without moving any file offset, so it's
+// safe to call concurrently on the same file.
+func readEntryAt(r io.ReaderAt, pos int64) (*entry, error) {
+	header := make([]byte, headerSize)
+	if _, err := r.ReadAt(header, pos); err != nil {
+		return nil, err
 	}
+	keySize := int(binary.LittleEndian.Uint32(header[4:]))
+	valueSize := int(binary.LittleEndian.Uint32(header[8:]))
 
-	sum, err := in.Peek(n + 8)
-	if err != nil {
-		return "", err
+	data := make([]byte, headerSize+keySize+valueSize+sumSize)
+	if _, err := r.ReadAt(data, pos); err != nil {
+		return nil, err
 	}
-	realSum := sha1.Sum(data)
-	if !bytes.Equal(sum, realSum[:]) {
-		return "", errors.New("sha1 sum mismatch")
+	if err := verifySum(data); err != nil {
+		return nil, err
 	}
 
-	return string(valueData), nil
+	var e entry
+	e.Decode(data)
+	return &e, nil
+}
+
+func readValue(in *bufio.Reader) (string, error) {
+	e, err := readEntry(in)
+	if err != nil {
+		return "", err
+	}
+	return e.value, nil
 }
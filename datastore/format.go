@@ -0,0 +1,268 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Every segment file starts with a header identifying its format:
+//
+//	magic (4) | format version (2) | creation time in Unix nanoseconds (8) | sequence number (8)
+//
+// No entry written before the file was created has a higher sequence number
+// than the one in the header, so the numbers keep growing after a restart
+// even when compaction has dropped the latest entries.
+//
+// Files written before the header was introduced are format version 0. They
+// start right with the first entry, and their entries only hold a key and a
+// string value:
+//
+//	size (4) | key length (4) | value length (4) | key | value | sha1 (20)
+const (
+	fileMagic      = "KVSG"
+	fileHeaderSize = 22
+
+	legacyFormatVersion = 0
+	formatVersion       = 1
+
+	legacyHeaderSize = 12
+)
+
+// ErrUnsupportedFormat is returned by NewDb for segment files it can't read.
+var ErrUnsupportedFormat = errors.New("unsupported segment format")
+
+type fileHeader struct {
+	version   uint16
+	createdAt time.Time
+	seq       uint64
+}
+
+func (h fileHeader) Encode() []byte {
+	res := make([]byte, fileHeaderSize)
+	copy(res, fileMagic)
+	binary.LittleEndian.PutUint16(res[4:], h.version)
+	binary.LittleEndian.PutUint64(res[6:], uint64(h.createdAt.UnixNano()))
+	binary.LittleEndian.PutUint64(res[14:], h.seq)
+	return res
+}
+
+// dataOffset returns where the first entry of the file starts.
+func (h fileHeader) dataOffset() int64 {
+	if h.version == legacyFormatVersion {
+		return 0
+	}
+	return fileHeaderSize
+}
+
+// entryHeaderSize returns the size of the entry headers in the file.
+func (h fileHeader) entryHeaderSize() int {
+	if h.version == legacyFormatVersion {
+		return legacyHeaderSize
+	}
+	return headerSize
+}
+
+func newFileHeader(seq uint64) fileHeader {
+	return fileHeader{version: formatVersion, createdAt: time.Now(), seq: seq}
+}
+
+// readFileHeader reads the header of a segment file. A file without the
+// magic is reported as the legacy format.
+func readFileHeader(r io.ReaderAt) (fileHeader, error) {
+	buf := make([]byte, fileHeaderSize)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return fileHeader{}, err
+	}
+	if n < len(fileMagic) || !bytes.Equal(buf[:len(fileMagic)], []byte(fileMagic)) {
+		return fileHeader{version: legacyFormatVersion}, nil
+	}
+	if n < fileHeaderSize {
+		return fileHeader{}, fmt.Errorf("truncated file header")
+	}
+	return fileHeader{
+		version:   binary.LittleEndian.Uint16(buf[4:]),
+		createdAt: time.Unix(0, int64(binary.LittleEndian.Uint64(buf[6:]))),
+		seq:       binary.LittleEndian.Uint64(buf[14:]),
+	}, nil
+}
+
+func readSegmentHeader(path string) (fileHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	defer f.Close()
+
+	h, err := readFileHeader(f)
+	if err != nil {
+		return fileHeader{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return h, nil
+}
+
+// checkFormat makes sure the segment file is in the current format and
+// returns its header.
+func checkFormat(path string) (fileHeader, error) {
+	h, err := readSegmentHeader(path)
+	if err != nil {
+		return h, err
+	}
+	switch h.version {
+	case formatVersion:
+		return h, nil
+	case legacyFormatVersion:
+		return h, fmt.Errorf("%s: %w: the file has no format header, run db migrate", path, ErrUnsupportedFormat)
+	default:
+		return h, unsupportedVersion(path, h.version)
+	}
+}
+
+func unsupportedVersion(path string, version uint16) error {
+	return fmt.Errorf("%s: %w: version %d, the supported one is %d", path, ErrUnsupportedFormat, version, formatVersion)
+}
+
+// Migrate rewrites the segments in dir that are in the legacy format into the
+// current one and returns their paths. The database must not be open.
+func Migrate(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries get sequence numbers in the order they were written, continuing
+	// after the segments a previous, interrupted run has migrated.
+	var seq uint64
+	var res []string
+	for _, n := range segmentNumbers(files) {
+		path := segmentPath(dir, n)
+		h, err := readSegmentHeader(path)
+		if err != nil {
+			return res, err
+		}
+		switch h.version {
+		case formatVersion:
+			s := &Segment{filePath: path}
+			if _, err := s.recover(false); err != nil {
+				return res, err
+			}
+			seq = maxSeq(seq, h.seq, s.lastSeq)
+		case legacyFormatVersion:
+			if err := migrateSegment(path, h, &seq); err != nil {
+				return res, err
+			}
+			res = append(res, path)
+		default:
+			return res, unsupportedVersion(path, h.version)
+		}
+	}
+	return res, nil
+}
+
+// migrateSegment rewrites a legacy segment with the current file header,
+// numbering its entries after seq. Entries are checked on the way, so
+// a damaged file is left as it is.
+func migrateSegment(path string, h fileHeader, seq *uint64) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + tmpSuffix
+	f, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	header := newFileHeader(*seq)
+	// The modification time is the closest thing to the creation time an old file has.
+	header.createdAt = info.ModTime()
+	out := bufio.NewWriterSize(f, bufSize)
+	if _, err := out.Write(header.Encode()); err != nil {
+		return err
+	}
+	offset := h.dataOffset()
+	reader := bufio.NewReaderSize(io.NewSectionReader(in, offset, info.Size()-offset), bufSize)
+	for {
+		e, n, err := readLegacyEntry(reader)
+		if err == io.EOF && offset == info.Size() {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %w at offset %d, run fsck to repair", path, ErrCorrupted, offset)
+		}
+		*seq++
+		e.setSeq(*seq)
+		if _, err := out.Write(e.Encode()); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// The offsets in the hint no longer match the file.
+	if err := os.Remove(hintPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readLegacyEntry reads an entry of the legacy format and returns it with its
+// size on disk. It becomes a string value that never expires.
+func readLegacyEntry(in *bufio.Reader) (entry, int, error) {
+	header, err := in.Peek(legacyHeaderSize)
+	if err != nil {
+		return entry{}, 0, err
+	}
+	if !validRecordSizeFor(header, legacyHeaderSize) {
+		return entry{}, 0, errors.New("invalid record size")
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header))
+	if _, err := io.ReadFull(in, data); err != nil {
+		return entry{}, 0, err
+	}
+	if err := verifySum(data); err != nil {
+		return entry{}, 0, err
+	}
+	kl := binary.LittleEndian.Uint32(header[4:])
+	return entry{
+		key:       string(data[legacyHeaderSize : legacyHeaderSize+kl]),
+		value:     string(data[legacyHeaderSize+kl : len(data)-sumSize]),
+		kind:      kindPut,
+		valueType: TypeString,
+	}, len(data), nil
+}
+
+func maxSeq(seqs ...uint64) uint64 {
+	var res uint64
+	for _, seq := range seqs {
+		if seq > res {
+			res = seq
+		}
+	}
+	return res
+}
@@ -0,0 +1,132 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Segments written before the file header existed.
+	legacy := append(encodeLegacy("key1", "value1"), encodeLegacy("key2", "value2")...)
+	if err := ioutil.WriteFile(segmentPath(dir, 0), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(segmentPath(dir, 1), encodeLegacy("key1", "value3"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("legacy segments are refused", func(t *testing.T) {
+		if _, err := NewDb(dir, 250); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Expected unsupported format error, got: %v", err)
+		}
+		found, err := Verify(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, len(found), 0)
+	})
+
+	t.Run("migrate", func(t *testing.T) {
+		migrated, err := Migrate(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, len(migrated), 2)
+
+		db, err := NewDb(dir, 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := db.Get("key1")
+		assertEqual(t, value, "value3")
+		value, _ = db.Get("key2")
+		assertEqual(t, value, "value2")
+		v, err := db.GetVersion("key2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, v.Type, TypeString)
+		assertEqual(t, v.ExpiresAt.IsZero(), true)
+		assertEqual(t, db.Seq(), uint64(3))
+		history, err := db.History("key1", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, len(history), 2)
+		assertEqual(t, history[1].Seq, uint64(1))
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if migrated, err = Migrate(dir); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, len(migrated), 0)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		header := fileHeader{version: formatVersion + 1, createdAt: time.Now()}
+		path := segmentPath(dir, 2)
+		if err := ioutil.WriteFile(path, header.Encode(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+
+		if _, err := NewDb(dir, 250); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Expected unsupported format error, got: %v", err)
+		}
+		if _, err := Migrate(dir); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Expected unsupported format error, got: %v", err)
+		}
+	})
+
+	t.Run("empty active segment", func(t *testing.T) {
+		path := segmentPath(dir, 2)
+		if err := ioutil.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := NewDb(dir, 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		db.Put("key4", "value4")
+		value, _ := db.Get("key4")
+		assertEqual(t, value, "value4")
+
+		h, err := readSegmentHeader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, h.version, uint16(formatVersion))
+	})
+}
+
+// encodeLegacy encodes a key and a value the way the segments were written
+// before the file header existed.
+func encodeLegacy(key, value string) []byte {
+	kl := len(key)
+	vl := len(value)
+	size := kl + vl + 32
+	res := make([]byte, size)
+	binary.LittleEndian.PutUint32(res, uint32(size))
+	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
+	binary.LittleEndian.PutUint32(res[8:], uint32(vl))
+	copy(res[12:], key)
+	copy(res[kl+12:], value)
+	sum := sha1.Sum(res[:size-20])
+	copy(res[size-20:], sum[:])
+	return res
+}
@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"os"
+)
+
+// A hint file lists the keys of a closed segment with the offsets, sizes and
+// kinds of their entries, so the index can be rebuilt and the live keys
+// counted without reading the values:
+//
+//	record:  key length (4) | key | offset (8) | size (4) | kind (1) | expiration time (8)
+//	trailer: flags (1) | data file size (8) | last sequence number (8) | sha1 of everything before (20)
+//
+// Records go in the order of the segment, so a later record of a key wins.
+const (
+	hintSuffix      = ".hint"
+	hintRecordSize  = 8 + 4 + 1 + 8
+	hintTrailerSize = 1 + 8 + 8 + sumSize
+
+	// hintCompacted marks the hint of a segment written by compaction, the
+	// only kind whose keys are sorted on disk.
+	hintCompacted byte = 1
+)
+
+var errBadHint = errors.New("invalid hint file")
+
+func hintPath(segmentPath string) string {
+	return segmentPath + hintSuffix
+}
+
+type hintWriter struct {
+	file    *os.File
+	out     *bufio.Writer
+	sum     hash.Hash
+	lastSeq uint64
+}
+
+func createHint(segmentPath string) (*hintWriter, error) {
+	f, err := os.OpenFile(hintPath(segmentPath), os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	w := &hintWriter{file: f, sum: sha1.New()}
+	w.out = bufio.NewWriterSize(io.MultiWriter(f, w.sum), bufSize)
+	return w, nil
+}
+
+func (w *hintWriter) add(k keyOffset) {
+	var buf [4 + hintRecordSize]byte
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(k.key)))
+	_, _ = w.out.Write(buf[:4])
+	_, _ = w.out.WriteString(k.key)
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(k.offset))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(k.size))
+	buf[16] = k.kind
+	binary.LittleEndian.PutUint64(buf[17:], uint64(k.expiresAt))
+	_, _ = w.out.Write(buf[4:])
+	if k.seq > w.lastSeq {
+		w.lastSeq = k.seq
+	}
+}
+
+// finish writes the trailer and closes the file. Write errors of add surface here.
+func (w *hintWriter) finish(dataSize int64, compacted bool) error {
+	var trailer [17]byte
+	if compacted {
+		trailer[0] = hintCompacted
+	}
+	binary.LittleEndian.PutUint64(trailer[1:], uint64(dataSize))
+	binary.LittleEndian.PutUint64(trailer[9:], w.lastSeq)
+	_, _ = w.out.Write(trailer[:])
+
+	err := w.out.Flush()
+	if err == nil {
+		_, err = w.file.Write(w.sum.Sum(nil))
+	}
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+	}
+	return err
+}
+
+// abort drops a hint that can't be completed.
+func (w *hintWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// writeHint creates the hint file of a closed segment by reading it once.
+func (s *Segment) writeHint() error {
+	w, err := createHint(s.filePath)
+	if err != nil {
+		return err
+	}
+	size, err := s.walk(w.add)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.finish(size, false); err != nil {
+		return err
+	}
+
+	// Compaction may have removed the segment meanwhile.
+	if _, err := os.Stat(s.filePath); os.IsNotExist(err) {
+		os.Remove(hintPath(s.filePath))
+	}
+	return nil
+}
+
+// hintTrailer is what the trailer of a hint tells about it.
+type hintTrailer struct {
+	compacted bool
+	dataSize  int64
+	lastSeq   uint64
+	// recordsSize is the length of the records before the trailer.
+	recordsSize int64
+}
+
+// readHint calls fn with every record of the hint file of the segment and
+// returns its trailer. It fails if the hint is missing, damaged or doesn't
+// match the data file, which may be after fn got some of the records.
+func (s *Segment) readHint(fn func(k keyOffset)) (hintTrailer, error) {
+	f, err := os.Open(hintPath(s.filePath))
+	if err != nil {
+		return hintTrailer{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return hintTrailer{}, err
+	}
+	if info.Size() < hintTrailerSize {
+		return hintTrailer{}, errBadHint
+	}
+	trailer := make([]byte, hintTrailerSize)
+	if _, err := f.ReadAt(trailer, info.Size()-hintTrailerSize); err != nil {
+		return hintTrailer{}, errBadHint
+	}
+
+	res := hintTrailer{
+		compacted:   trailer[0]&hintCompacted != 0,
+		dataSize:    int64(binary.LittleEndian.Uint64(trailer[1:])),
+		lastSeq:     binary.LittleEndian.Uint64(trailer[9:]),
+		recordsSize: info.Size() - hintTrailerSize,
+	}
+	segmentInfo, err := os.Stat(s.filePath)
+	if err != nil {
+		return hintTrailer{}, err
+	}
+	if segmentInfo.Size() != res.dataSize {
+		return hintTrailer{}, errBadHint
+	}
+
+	sum := sha1.New()
+	records := io.TeeReader(io.NewSectionReader(f, 0, res.recordsSize), sum)
+	if err := readHintRecords(records, res.recordsSize, fn); err != nil {
+		return hintTrailer{}, err
+	}
+	sum.Write(trailer[:17])
+	if !bytes.Equal(sum.Sum(nil), trailer[17:]) {
+		return hintTrailer{}, errBadHint
+	}
+	return res, nil
+}
+
+// loadHint rebuilds the index and the last sequence number of the segment
+// from its hint file: the full index of a segment written by the put
+// goroutine or the sparse one of a compacted segment, which is built straight
+// from the records. It fails if the hint is missing, damaged or doesn't match
+// the data file.
+func (s *Segment) loadHint() (int64, error) {
+	// The records are read twice: first to check the sum and count them, so
+	// the index is sized before it's built.
+	n := 0
+	trailer, err := s.readHint(func(keyOffset) {
+		n++
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(hintPath(s.filePath))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	records := io.NewSectionReader(f, 0, trailer.recordsSize)
+	if trailer.compacted {
+		sparse := newSparseIndex(n)
+		err := readHintRecords(records, trailer.recordsSize, func(k keyOffset) {
+			sparse.add(k.key, k.offset)
+		})
+		if err != nil {
+			return 0, err
+		}
+		s.sparse = sparse
+	} else {
+		index := make(hashIndex, n)
+		err := readHintRecords(records, trailer.recordsSize, func(k keyOffset) {
+			index[k.key] = k.offset
+		})
+		if err != nil {
+			return 0, err
+		}
+		s.index = index
+	}
+	s.lastSeq = trailer.lastSeq
+	return trailer.dataSize, nil
+}
+
+// readHintRecords calls fn with every record of a hint, which take size
+// bytes. The records have no sequence numbers.
+func readHintRecords(r io.Reader, size int64, fn func(k keyOffset)) error {
+	in := bufio.NewReaderSize(r, bufSize)
+	var buf [hintRecordSize]byte
+	for size > 0 {
+		if size < 4+hintRecordSize {
+			return errBadHint
+		}
+		if _, err := io.ReadFull(in, buf[:4]); err != nil {
+			return errBadHint
+		}
+		kl := int64(binary.LittleEndian.Uint32(buf[:4]))
+		if kl > size-4-hintRecordSize {
+			return errBadHint
+		}
+		key := make([]byte, kl)
+		if _, err := io.ReadFull(in, key); err != nil {
+			return errBadHint
+		}
+		if _, err := io.ReadFull(in, buf[:]); err != nil {
+			return errBadHint
+		}
+		fn(keyOffset{
+			key:       string(key),
+			offset:    int64(binary.LittleEndian.Uint64(buf[:8])),
+			size:      int64(binary.LittleEndian.Uint32(buf[8:12])),
+			kind:      buf[12],
+			expiresAt: int64(binary.LittleEndian.Uint64(buf[13:])),
+		})
+		size -= 4 + kl + hintRecordSize
+	}
+	return nil
+}
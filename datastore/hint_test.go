@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 126, WithCompactionThreshold(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.PutBatch(map[string]string{"key3": "value3"})
+	db.Put("key1", "value4")
+
+	time.Sleep(100 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := segmentPath(dir, 0)
+
+	t.Run("matches the segment", func(t *testing.T) {
+		fromHint := &Segment{filePath: closed}
+		size, err := fromHint.loadHint()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scanned := &Segment{filePath: closed, index: make(hashIndex)}
+		expectedSize, err := scanned.walk(func(k keyOffset) {
+			scanned.index[k.key] = k.offset
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, size, expectedSize)
+		// The keys happen to be in order, but only compaction sorts a segment.
+		assertEqual(t, fromHint.isSorted(), false)
+		assertEqual(t, len(fromHint.index), len(scanned.index))
+		for key, offset := range scanned.index {
+			assertEqual(t, fromHint.index[key], offset)
+		}
+	})
+
+	t.Run("damaged hint is ignored", func(t *testing.T) {
+		if err := ioutil.WriteFile(hintPath(closed), []byte("garbage"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (&Segment{filePath: closed}).loadHint(); err == nil {
+			t.Error("Expected an error for damaged hint")
+		}
+
+		db, err := NewDb(dir, 126, WithCompactionThreshold(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		expected := map[string]string{"key1": "value4", "key2": "value2", "key3": "value3"}
+		for key, value := range expected {
+			got, err := db.Get(key)
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", key, err)
+			}
+			assertEqual(t, got, value)
+		}
+	})
+
+	t.Run("stale hint is ignored", func(t *testing.T) {
+		s := &Segment{filePath: closed}
+		if err := s.writeHint(); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(closed, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := entry{key: "key5", value: "value5"}
+		_, err = f.Write(e.Encode())
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.loadHint(); err != errBadHint {
+			t.Errorf("Expected stale hint to be rejected, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"math"
+	"time"
+)
+
+// Version is a value a key held at some point. Seq is the sequence number of
+// the write, Value is stored the same way as in Iterator.Value, Deleted
+// marks the version written by Delete and ExpiresAt is zero unless the value
+// was written with a TTL.
+type Version struct {
+	Seq       uint64
+	Value     string
+	Type      ValueType
+	Deleted   bool
+	ExpiresAt time.Time
+}
+
+// Int64 decodes the value of an int64 version.
+func (v Version) Int64() (int64, error) {
+	if v.Type != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return decodeInt64(v.Value)
+}
+
+// Seq returns the sequence number of the last write.
+func (db *Db) Seq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.seq
+}
+
+// GetVersion returns the current value of the key with its type, read at
+// once, so a concurrent write can't change the type after it was checked.
+func (db *Db) GetVersion(key string) (Version, error) {
+	e, err := db.get(key)
+	if err != nil {
+		return Version{}, err
+	}
+	return e.version(), nil
+}
+
+// GetAt returns the value the key held right after the write with the
+// sequence number seq. It's ErrNotFound if the key was deleted or expired
+// then, or if the version was dropped by compaction.
+func (db *Db) GetAt(key string, seq uint64) (Version, error) {
+	var res *entry
+	err := db.versions(key, func(e *entry) bool {
+		if e.seq <= seq {
+			res = e
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return Version{}, err
+	}
+	if res == nil || res.isTombstone() || res.isExpired(time.Now()) {
+		return Version{}, ErrNotFound
+	}
+	return res.version(), nil
+}
+
+// History returns up to limit latest versions of the key, newest first; a
+// limit of zero returns all of them. Besides the versions compaction keeps
+// (see WithRetention), it includes the ones still in the segments that
+// weren't compacted yet.
+func (db *Db) History(key string, limit int) ([]Version, error) {
+	var res []Version
+	err := db.versions(key, func(e *entry) bool {
+		res = append(res, e.version())
+		return limit <= 0 || len(res) < limit
+	})
+	return res, err
+}
+
+// versions calls fn with the entries of the key from the newest one until fn
+// returns false. The values are decompressed.
+func (db *Db) versions(key string, fn func(e *entry) bool) error {
+	return db.versionsBefore(key, math.MaxUint64, fn)
+}
+
+// versionsBefore is versions limited to the entries older than before.
+func (db *Db) versionsBefore(key string, before uint64, fn func(e *entry) bool) error {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return ErrClosed
+	}
+	segments := make([]*Segment, len(db.segments))
+	copy(segments, db.segments)
+	generation := db.generation
+	// The active segment's index is only read under the lock.
+	latest, inActive := db.getLastSegment().index[key]
+	db.mu.RUnlock()
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		var found []*entry
+		var err error
+		if i == len(segments)-1 {
+			if inActive {
+				found, err = s.versionsUpTo(key, latest)
+			}
+		} else {
+			found, err = s.versions(key)
+		}
+		if retry, err := db.readFailed(generation, err); retry {
+			// Compaction merged the segment meanwhile; continue after the
+			// versions fn has already seen.
+			return db.versionsBefore(key, before, fn)
+		} else if err != nil {
+			return err
+		}
+
+		for j := len(found) - 1; j >= 0; j-- {
+			e := found[j]
+			if e.seq >= before {
+				continue
+			}
+			if err := e.decompress(); err != nil {
+				return err
+			}
+			before = e.seq
+			if !fn(e) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (e *entry) version() Version {
+	v := Version{
+		Seq:     e.seq,
+		Value:   e.value,
+		Type:    e.valueType,
+		Deleted: e.isTombstone(),
+	}
+	if e.expiresAt != 0 {
+		v.ExpiresAt = time.Unix(0, e.expiresAt)
+	}
+	return v
+}
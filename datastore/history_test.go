@@ -0,0 +1,167 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_History(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 300, WithRetention(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("key", "v1")
+	db.Put("key", "v2")
+	db.PutBatch(map[string]string{"key": "v3", "other": "x"})
+	db.Delete("key")
+	db.Put("key", "v5")
+
+	t.Run("history", func(t *testing.T) {
+		history, err := db.History("key", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for i, v := range history {
+			if i > 0 && v.Seq >= history[i-1].Seq {
+				t.Errorf("Versions are not ordered: %d after %d", v.Seq, history[i-1].Seq)
+			}
+			if v.Deleted {
+				values = append(values, "deleted")
+			} else {
+				values = append(values, v.Value)
+			}
+		}
+		assertEqual(t, strings.Join(values, ","), "v5,deleted,v3,v2,v1")
+		assertEqual(t, history[0].Seq, db.Seq())
+
+		if limited, _ := db.History("key", 2); len(limited) != 2 {
+			t.Errorf("Expected 2 versions, got %d", len(limited))
+		}
+		if none, _ := db.History("missing", 0); len(none) != 0 {
+			t.Errorf("Expected no versions, got %d", len(none))
+		}
+	})
+
+	t.Run("current version", func(t *testing.T) {
+		v, err := db.GetVersion("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, v.Value, "v5")
+		assertEqual(t, v.Type, TypeString)
+		assertEqual(t, v.Seq, db.Seq())
+		if _, err := db.GetVersion("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got: %v", err)
+		}
+	})
+
+	t.Run("get at", func(t *testing.T) {
+		v, err := db.GetAt("key", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, v.Value, "v2")
+		// The batch is the third write.
+		v, _ = db.GetAt("key", 3)
+		assertEqual(t, v.Value, "v3")
+		if _, err := db.GetAt("key", 4); err != ErrNotFound {
+			t.Errorf("Expected deleted version, got: %v", err)
+		}
+		if _, err := db.GetAt("key", 0); err != ErrNotFound {
+			t.Errorf("Expected no version before the first write, got: %v", err)
+		}
+	})
+
+	t.Run("compaction keeps retention", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			db.Put(fmt.Sprintf("filler%d", i), "value")
+		}
+		time.Sleep(2 * time.Second)
+
+		if !segmentsOf(db)[0].isSorted() {
+			t.Fatal("Expected the segments to be compacted")
+		}
+		history, err := db.History("key", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, len(history), 2)
+		assertEqual(t, history[0].Value, "v5")
+		assertEqual(t, history[1].Deleted, true)
+		if _, err := db.GetAt("key", 2); err != ErrNotFound {
+			t.Errorf("Expected the version to be dropped, got: %v", err)
+		}
+		value, _ := db.Get("key")
+		assertEqual(t, value, "v5")
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		db.Delete("filler9")
+		seq := db.Seq()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 300, WithRetention(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		assertEqual(t, db.Seq(), seq)
+		db.Put("key", "v6")
+		history, _ := db.History("key", 0)
+		assertEqual(t, history[0].Seq, seq+1)
+		assertEqual(t, history[1].Value, "v5")
+	})
+}
+
+func TestDb_HistoryAcrossBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 20000, WithRetention(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Versions larger than a block of the sparse index.
+	for i := 0; i < 4; i++ {
+		db.Put("a", "small")
+		db.Put("big", strings.Repeat(fmt.Sprint(i), blockSize))
+		db.Put("c", "small")
+	}
+	for i := 0; i < 10; i++ {
+		db.Put(fmt.Sprintf("filler%d", i), strings.Repeat("x", blockSize))
+	}
+	time.Sleep(2 * time.Second)
+
+	if !segmentsOf(db)[0].isSorted() {
+		t.Fatal("Expected the segments to be compacted")
+	}
+	history, err := db.History("big", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(history), 3)
+	for i, v := range history {
+		assertEqual(t, v.Value[:1], fmt.Sprint(3-i))
+	}
+	value, _ := db.Get("big")
+	assertEqual(t, value[:1], "3")
+}
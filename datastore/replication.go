@@ -0,0 +1,275 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// LogPosition points into the write log of a Db, which is its segments read
+// in the order of their numbers. The zero position is the start of the log.
+type LogPosition struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// ErrLogTruncated means that the records after the position were merged by
+// compaction, so a replica has to copy the whole database again.
+var ErrLogTruncated = errors.New("log position is no longer available")
+
+// Head returns the position right after the last record written.
+func (db *Db) Head() LogPosition {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return LogPosition{Segment: db.getLastSegment().number, Offset: db.outOffset}
+}
+
+// ReadLog returns whole encoded records starting at pos, about limit bytes of
+// them, with the position following them and the number of bytes left in
+// the log after it.
+func (db *Db) ReadLog(pos LogPosition, limit int64) ([]byte, LogPosition, int64, error) {
+	from := pos
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return nil, pos, 0, ErrClosed
+	}
+	generation := db.generation
+	s, end, lag, pos, err := db.logSegment(pos)
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, pos, 0, err
+	}
+
+	var res []byte
+	in := bufio.NewReaderSize(s.reader(pos.Offset), bufSize)
+	for pos.Offset < end && int64(len(res)) < limit {
+		header, err := in.Peek(headerSize)
+		if retry, err := db.readFailed(generation, err); retry {
+			// The records read so far are dropped, so start over.
+			return db.ReadLog(from, limit)
+		} else if err != nil {
+			return nil, pos, 0, err
+		}
+		record := make([]byte, binary.LittleEndian.Uint32(header))
+		_, err = io.ReadFull(in, record)
+		if retry, err := db.readFailed(generation, err); retry {
+			return db.ReadLog(from, limit)
+		} else if err != nil {
+			return nil, pos, 0, err
+		}
+		res = append(res, record...)
+		pos.Offset += int64(len(record))
+	}
+	return res, pos, lag + end - pos.Offset, nil
+}
+
+// logSegment finds the segment to read pos from, moving pos to the start of
+// the next segment when the one it points to is read to the end. It also
+// returns where the readable part of the segment ends and how many bytes
+// the segments after it hold. The caller must hold db.mu.
+func (db *Db) logSegment(pos LogPosition) (*Segment, int64, int64, LogPosition, error) {
+	if pos == (LogPosition{}) {
+		pos = LogPosition{Segment: db.segments[0].number, Offset: fileHeaderSize}
+	}
+
+	i := db.segmentAfter(pos.Segment - 1)
+	if i == len(db.segments) || db.segments[i].number != pos.Segment {
+		// A segment merged by compaction is skipped when it was read to the
+		// end: the segments after it hold everything written later.
+		size, ok := db.retired[pos.Segment]
+		if !ok || pos.Offset != size || i == len(db.segments) || db.retiredBetween(pos.Segment, db.segments[i].number) {
+			return nil, 0, 0, pos, ErrLogTruncated
+		}
+		pos = LogPosition{Segment: db.segments[i].number, Offset: fileHeaderSize}
+	}
+
+	for {
+		s := db.segments[i]
+		end := s.outOffset
+		last := i == len(db.segments)-1
+		if last {
+			end = db.outOffset
+		}
+		if pos.Offset > end {
+			return nil, 0, 0, pos, fmt.Errorf("offset %d is beyond the end of segment %d", pos.Offset, pos.Segment)
+		}
+		if pos.Offset < end || last {
+			var lag int64
+			for _, next := range db.segments[i+1:] {
+				lag += next.outOffset - fileHeaderSize
+			}
+			if !last {
+				lag += db.outOffset - db.getLastSegment().outOffset
+			}
+			return s, end, lag, pos, nil
+		}
+		i++
+		pos = LogPosition{Segment: db.segments[i].number, Offset: fileHeaderSize}
+	}
+}
+
+// segmentAfter returns the index of the first segment numbered above n.
+func (db *Db) segmentAfter(n int) int {
+	for i, s := range db.segments {
+		if s.number > n {
+			return i
+		}
+	}
+	return len(db.segments)
+}
+
+// retiredBetween tells whether a segment merged by compaction was numbered
+// between from and to.
+func (db *Db) retiredBetween(from, to int) bool {
+	for n := range db.retired {
+		if n > from && n < to {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply writes records read from the log of another Db with ReadLog. Every
+// record keeps its checksum-verified contents, so batches stay atomic, and
+// its sequence number, so both Dbs number the versions of a key the same.
+func (db *Db) Apply(records []byte) error {
+	for len(records) > 0 {
+		if len(records) < headerSize || !validRecordSize(records) {
+			return fmt.Errorf("%w: invalid record size", ErrCorrupted)
+		}
+		size := int(binary.LittleEndian.Uint32(records))
+		if size > len(records) {
+			return fmt.Errorf("%w: truncated record", ErrCorrupted)
+		}
+		if err := verifySum(records[:size]); err != nil {
+			return fmt.Errorf("%w: %s", ErrCorrupted, err)
+		}
+
+		var e entry
+		e.Decode(records[:size])
+		e.compress(db.compression)
+		if err := db.submit(putOp{entry: e, replicated: true}); err != nil {
+			return err
+		}
+		records = records[size:]
+	}
+	return nil
+}
+
+// Replace swaps the contents of the database for those of src, a Db open in
+// another directory on the same filesystem, e.g. one a replica rebuilt from
+// the log of its primary. src is closed and its segments are moved into the
+// directory of db. Reads see either the old contents or the new ones, and
+// writes wait until the swap is done.
+func (db *Db) Replace(src *Db) error {
+	src.stopCompaction()
+	if err := src.submit(putOp{run: src.syncOut}); err != nil {
+		return err
+	}
+	if err := src.Close(); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(src.dir)
+	if err != nil {
+		return err
+	}
+	numbers := segmentNumbers(files)
+
+	paused := db.stopCompaction()
+	defer func() {
+		if !paused {
+			db.ResumeCompaction()
+		}
+	}()
+	db.removeMu.Lock()
+	defer db.removeMu.Unlock()
+
+	var old []*Segment
+	err = db.submit(putOp{run: func() error {
+		segments, err := db.moveSegments(src.dir, numbers)
+		if err != nil {
+			return err
+		}
+		active := segments[len(segments)-1]
+		out, err := os.OpenFile(active.filePath, os.O_APPEND|os.O_RDWR, 0777)
+		if err == nil {
+			err = syncDir(db.dir)
+		}
+		if err != nil {
+			if out != nil {
+				out.Close()
+			}
+			removeSegments(segments)
+			return err
+		}
+		var seq uint64
+		for _, segment := range segments {
+			seq = maxSeq(seq, segment.startSeq, segment.lastSeq)
+		}
+
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.out.Close()
+		old = db.segments
+		db.segments = segments
+		db.out = out
+		db.outPath = active.filePath
+		db.outOffset = active.outOffset
+		db.seq = seq
+		db.generation++
+		// Positions in the old log mean nothing for the new one.
+		db.retired = make(map[int]int64)
+		return nil
+	}})
+	if err != nil {
+		return err
+	}
+
+	// Reads still holding the old segments fail with os.ErrClosed and look
+	// the key up again.
+	removeSegments(old)
+	return nil
+}
+
+// moveSegments moves the segments with the given numbers from dir into the
+// directory of db, numbered after the current ones, and loads them. Nothing
+// is left in the directory of db if it fails. Only the put goroutine calls
+// it.
+func (db *Db) moveSegments(dir string, numbers []int) ([]*Segment, error) {
+	if len(numbers) == 0 {
+		return nil, fmt.Errorf("%s contains no segments", dir)
+	}
+	var segments []*Segment
+	for i, n := range numbers {
+		from, to := segmentPath(dir, n), db.getNewFileName()
+		err := os.Rename(from, to)
+		if err == nil {
+			// A hint that is still being written stays behind and is
+			// removed by its writer.
+			os.Rename(hintPath(from), hintPath(to))
+			var segment *Segment
+			if segment, err = loadSegment(to, i == len(numbers)-1); err == nil {
+				segments = append(segments, segment)
+				continue
+			}
+			os.Remove(to)
+			os.Remove(hintPath(to))
+		}
+		removeSegments(segments)
+		return nil, err
+	}
+	return segments, nil
+}
+
+// removeSegments closes the segments and deletes their files.
+func removeSegments(segments []*Segment) {
+	for _, s := range segments {
+		s.close()
+		os.Remove(s.filePath)
+		os.Remove(hintPath(s.filePath))
+	}
+}
@@ -0,0 +1,282 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDb_Replication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"primary", "replica", "fresh"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	primary, err := NewDb(filepath.Join(dir, "primary"), 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	replica, err := NewDb(filepath.Join(dir, "replica"), 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	var pos LogPosition
+	replicate := func(t *testing.T) error {
+		t.Helper()
+		for {
+			records, next, lag, err := primary.ReadLog(pos, 100)
+			if err != nil {
+				return err
+			}
+			if err := replica.Apply(records); err != nil {
+				t.Fatal(err)
+			}
+			pos = next
+			if lag == 0 {
+				return nil
+			}
+		}
+	}
+
+	t.Run("copies writes", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			primary.Put(fmt.Sprintf("key%d", i), "value")
+		}
+		primary.PutInt64("counter", 7)
+		primary.PutBatch(map[string]string{"b1": "v1", "b2": "v2"})
+		primary.Delete("key0")
+
+		if err := replicate(t); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, pos, primary.Head())
+
+		value, _ := replica.Get("key4")
+		assertEqual(t, value, "value")
+		value, _ = replica.Get("b2")
+		assertEqual(t, value, "v2")
+		counter, _ := replica.GetInt64("counter")
+		assertEqual(t, counter, int64(7))
+		_, err := replica.Get("key0")
+		assertEqual(t, err, ErrNotFound)
+	})
+
+	t.Run("continues after compaction", func(t *testing.T) {
+		time.Sleep(2 * time.Second)
+		// The replica reads the active segment to the end, then it's merged
+		// by the compaction started on the rollover.
+		for i := 0; pos.Segment == primary.Head().Segment; i++ {
+			if err := replicate(t); err != nil {
+				t.Fatal(err)
+			}
+			primary.Put(fmt.Sprintf("key%d", i), "new")
+		}
+		time.Sleep(2 * time.Second)
+		primary.mu.RLock()
+		_, ok := primary.retired[pos.Segment]
+		primary.mu.RUnlock()
+		if !ok {
+			t.Fatalf("Expected segment %d to be compacted", pos.Segment)
+		}
+
+		if err := replicate(t); err != nil {
+			t.Fatal(err)
+		}
+		value, _ := replica.Get("key0")
+		assertEqual(t, value, "new")
+	})
+
+	t.Run("same versions", func(t *testing.T) {
+		// A new replica starts with the segment written by compaction, whose
+		// entries go in key order.
+		fresh, err := NewDb(filepath.Join(dir, "fresh"), 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fresh.Close()
+		copyLog(t, primary, fresh, LogPosition{})
+
+		assertEqual(t, fresh.Seq(), primary.Seq())
+		for _, key := range []string{"key0", "key3", "counter", "b1"} {
+			expected, err := primary.History(key, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := fresh.History(key, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, len(got), len(expected))
+			for i := range expected {
+				assertEqual(t, got[i], expected[i])
+			}
+		}
+
+		// The compacted segment holds the numbers out of order, but the
+		// changes are replayed in order.
+		w, err := fresh.WatchFrom("", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		keys := map[string]bool{}
+		var last uint64
+		for last < fresh.Seq() {
+			select {
+			case e := <-w.C:
+				if e.Seq < last {
+					t.Fatalf("Expected the changes in order, got %d after %d", e.Seq, last)
+				}
+				keys[e.Key] = true
+				last = e.Seq
+			case <-time.After(time.Second):
+				t.Fatalf("Expected the changes up to %d, got up to %d", fresh.Seq(), last)
+			}
+		}
+		for _, key := range []string{"key3", "counter", "b1"} {
+			if !keys[key] {
+				t.Errorf("Expected a change of %s", key)
+			}
+		}
+	})
+
+	t.Run("compacted position", func(t *testing.T) {
+		stale := pos
+		for i := 0; i < 10; i++ {
+			primary.Put(fmt.Sprintf("key%d", i), "latest")
+		}
+		time.Sleep(2 * time.Second)
+
+		if _, _, _, err := primary.ReadLog(stale, 100); err != ErrLogTruncated {
+			t.Errorf("Expected truncated log, got: %v", err)
+		}
+	})
+}
+
+// copyLog applies the log of from after pos to to and returns the position
+// at its end.
+func copyLog(t *testing.T, from, to *Db, pos LogPosition) LogPosition {
+	t.Helper()
+	for {
+		records, next, lag, err := from.ReadLog(pos, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := to.Apply(records); err != nil {
+			t.Fatal(err)
+		}
+		pos = next
+		if lag == 0 {
+			return pos
+		}
+	}
+}
+
+func TestDb_Replace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"primary", "replica", "replica/resync"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	primary, err := NewDb(filepath.Join(dir, "primary"), 250, WithCompactionThreshold(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	replica, err := NewDb(filepath.Join(dir, "replica"), 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { replica.Close() }()
+
+	for i := 0; i < 20; i++ {
+		primary.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	pos := copyLog(t, primary, replica, LogPosition{})
+
+	// The replica falls behind while the segment it reads is compacted.
+	primary.Delete("key0")
+	primary.Put("key1", "new")
+	if err := primary.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := primary.ReadLog(pos, 100); err != ErrLogTruncated {
+		t.Fatalf("Expected truncated log, got: %v", err)
+	}
+
+	fresh, err := NewDb(filepath.Join(dir, "replica", "resync"), 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos = copyLog(t, primary, fresh, LogPosition{})
+
+	// The replica keeps answering while the rebuilt data is swapped in.
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				readErr <- nil
+				return
+			default:
+			}
+			if _, err := replica.Get("key5"); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	if err := replica.Replace(fresh); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	if err := <-readErr; err != nil {
+		t.Errorf("Cannot read during the swap: %s", err)
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		if _, err := replica.Get("key0"); err != ErrNotFound {
+			t.Errorf("Expected key0 to be deleted, got: %v", err)
+		}
+		value, _ := replica.Get("key1")
+		assertEqual(t, value, "new")
+		value, _ = replica.Get("key2")
+		assertEqual(t, value, "after")
+		assertEqual(t, replica.Seq(), primary.Seq())
+	}
+
+	primary.Put("key2", "after")
+	copyLog(t, primary, replica, pos)
+	check(t)
+
+	if err := replica.Close(); err != nil {
+		t.Fatal(err)
+	}
+	replica, err = NewDb(filepath.Join(dir, "replica"), 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t)
+	files, _ := os.ReadDir(filepath.Join(dir, "replica", "resync"))
+	assertEqual(t, len(segmentNumbers(files)), 0)
+}
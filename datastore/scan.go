@@ -0,0 +1,207 @@
+package datastore
+
+import (
+	"sort"
+)
+
+// Iterator walks over live keys in sorted order. The keys are merged from
+// the segments as Next goes and the values are read lazily, so a key deleted
+// or overwritten after the iterator was created shows its state at the moment
+// Next reaches it.
+type Iterator struct {
+	db    *Db
+	end   string
+	heads []*keyHead
+	// generation is the one of the segments the heads were taken from.
+	generation uint64
+	entry      *entry
+	err        error
+}
+
+// keyCursor yields the keys of a segment in a range in ascending order.
+type keyCursor interface {
+	next() (key string, ok bool, err error)
+}
+
+// keyHead is the next key of a cursor; ok is false once it's exhausted.
+type keyHead struct {
+	cursor keyCursor
+	key    string
+	ok     bool
+}
+
+func (h *keyHead) advance() error {
+	var err error
+	h.key, h.ok, err = h.cursor.next()
+	return err
+}
+
+// keyList yields the keys of a hash-indexed segment, sorted when the
+// iterator is positioned.
+type keyList []string
+
+func (l *keyList) next() (string, bool, error) {
+	if len(*l) == 0 {
+		return "", false, nil
+	}
+	key := (*l)[0]
+	*l = (*l)[1:]
+	return key, true, nil
+}
+
+// Range returns an iterator over the keys in [start, end). An empty end means
+// there is no upper bound.
+func (db *Db) Range(start, end string) *Iterator {
+	it := &Iterator{db: db, end: end}
+	it.err = it.seek(start)
+	return it
+}
+
+// seek positions the iterator at start over the current segments. Only the
+// keys of the hash-indexed segments are collected up front; sorted segments
+// are read from the block holding start as the iterator advances.
+func (it *Iterator) seek(start string) error {
+	it.db.mu.RLock()
+	if it.db.closed {
+		it.db.mu.RUnlock()
+		return ErrClosed
+	}
+	it.generation = it.db.generation
+	it.heads = make([]*keyHead, 0, len(it.db.segments))
+	for _, s := range it.db.segments {
+		if s.isSorted() {
+			it.heads = append(it.heads, &keyHead{cursor: s.keysInRange(start, it.end)})
+			continue
+		}
+		var keys keyList
+		for key := range s.index {
+			if key >= start && (it.end == "" || key < it.end) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		it.heads = append(it.heads, &keyHead{cursor: &keys})
+	}
+	it.db.mu.RUnlock()
+
+	// Sorted segments are immutable, so their files are read without the lock.
+	for _, h := range it.heads {
+		err := h.advance()
+		if retry, err := it.db.readFailed(it.generation, err); retry {
+			// The segment was compacted away meanwhile.
+			return it.seek(start)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// smallest returns the least key among the heads.
+func (it *Iterator) smallest() (string, bool) {
+	var res string
+	found := false
+	for _, h := range it.heads {
+		if h.ok && (!found || h.key < res) {
+			res, found = h.key, true
+		}
+	}
+	return res, found
+}
+
+// skip advances all the heads past key.
+func (it *Iterator) skip(key string) error {
+	for _, h := range it.heads {
+		for h.ok && h.key == key {
+			if err := h.advance(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Scan returns an iterator over the keys starting with prefix.
+func (db *Db) Scan(prefix string) *Iterator {
+	return db.ScanFrom(prefix, prefix)
+}
+
+// ScanFrom is like Scan but skips the keys less than start, which lets a
+// listing continue after the last key of the previous page.
+func (db *Db) ScanFrom(prefix, start string) *Iterator {
+	if start < prefix {
+		start = prefix
+	}
+	return db.Range(start, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key greater than all keys with the prefix,
+// or an empty string if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Next moves to the next live key. It returns false when there are no more
+// keys or an error occurred, which is then available from Err.
+func (it *Iterator) Next() bool {
+	for it.err == nil {
+		key, ok := it.smallest()
+		if !ok {
+			break
+		}
+		err := it.skip(key)
+		if retry, err := it.db.readFailed(it.generation, err); retry {
+			// Compaction merged a segment meanwhile; continue from the key
+			// over the new segments.
+			it.err = it.seek(key)
+			continue
+		} else if err != nil {
+			it.err = err
+			break
+		}
+
+		e, err := it.db.get(key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			it.err = err
+			break
+		}
+		it.entry = e
+		return true
+	}
+	it.entry = nil
+	return false
+}
+
+func (it *Iterator) Key() string {
+	return it.entry.key
+}
+
+// Value returns the value as it's stored; use Type to interpret non-string values.
+func (it *Iterator) Value() string {
+	return it.entry.value
+}
+
+// Int64 decodes the value of an int64 key.
+func (it *Iterator) Int64() (int64, error) {
+	if err := checkType(it.entry, TypeInt64); err != nil {
+		return 0, err
+	}
+	return decodeInt64(it.entry.value)
+}
+
+func (it *Iterator) Type() ValueType {
+	return it.entry.valueType
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
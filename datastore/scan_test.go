@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 126)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("user:2", "old")
+	db.Put("order:1", "value")
+	db.Put("user:1", "value")
+	db.Put("user:3", "value")
+	db.Put("user:2", "new")
+	db.Put("user:4", "value")
+	db.Delete("user:3")
+
+	time.Sleep(2 * time.Second)
+
+	collect := func(it *Iterator) string {
+		var res []string
+		for it.Next() {
+			res = append(res, it.Key()+"="+it.Value())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(res, ",")
+	}
+
+	t.Run("prefix", func(t *testing.T) {
+		assertEqual(t, collect(db.Scan("user:")), "user:1=value,user:2=new,user:4=value")
+	})
+
+	t.Run("range", func(t *testing.T) {
+		assertEqual(t, collect(db.Range("order:1", "user:2")), "order:1=value,user:1=value")
+		assertEqual(t, collect(db.Range("user:2", "")), "user:2=new,user:4=value")
+	})
+
+	t.Run("prefix end", func(t *testing.T) {
+		assertEqual(t, prefixEnd("ab"), "ac")
+		assertEqual(t, prefixEnd("a\xff"), "b")
+		assertEqual(t, prefixEnd("\xff"), "")
+	})
+}
+
+func TestDb_ScanDuringCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 4096, WithCompactionThreshold(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The compacted segment is larger than the read buffer of its cursor.
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 300; i++ {
+		db.Put(fmt.Sprintf("key%03d", i), value)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	it := db.Scan("key")
+	count := 0
+	for it.Next() {
+		assertEqual(t, it.Key(), fmt.Sprintf("key%03d", count))
+		count++
+		if count == 10 {
+			// The segment the iterator reads is merged away.
+			db.Put("key000", "new")
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, count, 300)
+}
@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Snapshot writes a point-in-time copy of the database to dir while it keeps
+// serving requests. The active segment is rolled over, so every segment of the
+// snapshot is immutable; the files are hard-linked when dir is on the same
+// filesystem and copied otherwise. The snapshot gets an empty active segment
+// of its own, so opening it with NewDb never writes to the linked files.
+func (db *Db) Snapshot(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(segmentNumbers(files)) > 0 {
+		return fmt.Errorf("%s already contains segments", dir)
+	}
+
+	db.removeMu.Lock()
+	defer db.removeMu.Unlock()
+
+	var frozen []*Segment
+	var seq uint64
+	err = db.submit(putOp{run: func() error {
+		if err := db.syncOut(); err != nil {
+			return err
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		frozen = append(frozen, db.segments...)
+		seq = db.seq
+		return db.addSegment()
+	}})
+	if err != nil {
+		return err
+	}
+
+	for i, s := range frozen {
+		path := segmentPath(dir, i)
+		if err := linkOrCopy(s.filePath, path); err != nil {
+			return err
+		}
+		// The hint spares reading the segment when the snapshot is opened. The
+		// one of the segment just rolled over may not be written yet.
+		if err := linkOrCopy(hintPath(s.filePath), hintPath(path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	active, err := os.OpenFile(segmentPath(dir, len(frozen)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = active.Write(newFileHeader(seq).Encode())
+	if closeErr := active.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDb_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotDir := filepath.Join(dir, "snapshot")
+	dataDir := filepath.Join(dir, "data")
+	if err := os.Mkdir(dataDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDb(dataDir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 6; i++ {
+		db.Put(fmt.Sprintf("key%d", i), "before")
+	}
+	// The hint of a closed segment is written in the background.
+	closed := segmentsOf(db)[0].filePath
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(hintPath(closed)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := db.Snapshot(snapshotDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Segment{filePath: segmentPath(snapshotDir, 0)}).loadHint(); err != nil {
+		t.Errorf("Expected the hint of the first segment in the snapshot, got: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		db.Put(fmt.Sprintf("key%d", i), "after")
+	}
+	db.Put("new", "after")
+	// Let compaction remove the segments the snapshot links to.
+	time.Sleep(2 * time.Second)
+
+	t.Run("refuses non-empty dir", func(t *testing.T) {
+		if err := db.Snapshot(snapshotDir); err == nil {
+			t.Error("Expected an error for a directory with segments")
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		restored, err := NewDb(snapshotDir, 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+
+		for i := 0; i < 6; i++ {
+			value, err := restored.Get(fmt.Sprintf("key%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, value, "before")
+		}
+		if _, err := restored.Get("new"); err != ErrNotFound {
+			t.Errorf("Expected not found, got: %v", err)
+		}
+
+		restored.Put("key0", "restored")
+		value, _ := db.Get("key0")
+		assertEqual(t, value, "after")
+	})
+}
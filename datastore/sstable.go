@@ -0,0 +1,303 @@
+package datastore
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+)
+
+// blockSize is the approximate distance between keys of a sparse index, so a
+// lookup in a sorted segment reads about this many bytes.
+const blockSize = 4096
+
+// sparseIndex is the in-memory index of a sorted segment: the first key of
+// every block with its offset, plus a Bloom filter of all the keys. Versions
+// of a key kept by compaction follow each other, oldest first.
+type sparseIndex struct {
+	keys    []string
+	offsets []int64
+	filter  *bloomFilter
+	count   int
+	last    string
+}
+
+func newSparseIndex(n int) *sparseIndex {
+	return &sparseIndex{filter: newBloomFilter(n)}
+}
+
+// add registers the next key of the segment; keys must come in ascending order.
+func (idx *sparseIndex) add(key string, offset int64) {
+	if len(idx.offsets) == 0 || offset-idx.offsets[len(idx.offsets)-1] >= blockSize {
+		idx.keys = append(idx.keys, key)
+		idx.offsets = append(idx.offsets, offset)
+	}
+	if idx.count == 0 || key != idx.last {
+		idx.filter.add(key)
+		idx.count++
+		idx.last = key
+	}
+}
+
+// blockFor returns the offset of the last block starting with a key less than
+// the given one, so all the versions of the key come after it.
+func (idx *sparseIndex) blockFor(key string) int64 {
+	i := sort.Search(len(idx.keys), func(i int) bool {
+		return idx.keys[i] >= key
+	}) - 1
+	if i < 0 {
+		return fileHeaderSize
+	}
+	return idx.offsets[i]
+}
+
+func (s *Segment) isSorted() bool {
+	return s.sparse != nil
+}
+
+// keyCount returns the number of distinct keys in the segment.
+func (s *Segment) keyCount() int {
+	if s.isSorted() {
+		return s.sparse.count
+	}
+	return len(s.index)
+}
+
+// find returns the position of the latest entry of the key in the segment.
+func (s *Segment) find(key string) (int64, bool, error) {
+	if !s.isSorted() {
+		pos, ok := s.index[key]
+		return pos, ok, nil
+	}
+
+	if !s.sparse.filter.mayContain(key) {
+		return 0, false, nil
+	}
+
+	var pos int64
+	found := false
+	err := s.scan(s.sparse.blockFor(key), func(e *entry, offset int64) bool {
+		if e.key == key {
+			pos, found = offset, true
+		}
+		return e.key <= key
+	})
+	return pos, found, err
+}
+
+// versions returns the entries of the key in a closed segment, oldest first.
+func (s *Segment) versions(key string) ([]*entry, error) {
+	var res []*entry
+	if s.isSorted() {
+		if !s.sparse.filter.mayContain(key) {
+			return nil, nil
+		}
+		err := s.scan(s.sparse.blockFor(key), func(e *entry, _ int64) bool {
+			if e.key == key {
+				res = append(res, e)
+			}
+			return e.key <= key
+		})
+		return res, err
+	}
+
+	latest, ok := s.index[key]
+	if !ok {
+		return nil, nil
+	}
+	return s.versionsUpTo(key, latest)
+}
+
+// versionsUpTo returns the entries of the key in a hash-indexed segment up to
+// the one at the latest position, so the active segment is never read past
+// the records that are written completely.
+func (s *Segment) versionsUpTo(key string, latest int64) ([]*entry, error) {
+	var res []*entry
+	err := s.scan(fileHeaderSize, func(e *entry, offset int64) bool {
+		if e.kind == kindBatch {
+			for _, inner := range e.batchEntries() {
+				if inner.key == key {
+					inner := inner
+					res = append(res, &inner)
+				}
+			}
+		} else if e.key == key {
+			res = append(res, e)
+		}
+		return offset+e.size() <= latest
+	})
+	return res, err
+}
+
+// rangeCursor yields the keys of a sorted segment in [start, end) in order.
+// Keys with several versions are yielded several times.
+type rangeCursor struct {
+	cursor     *fileCursor
+	start, end string
+}
+
+// keysInRange returns a cursor over the keys of a sorted segment in
+// [start, end). Nothing is read until next is called.
+func (s *Segment) keysInRange(start, end string) *rangeCursor {
+	return &rangeCursor{cursor: newFileCursor(s, s.sparse.blockFor(start)), start: start, end: end}
+}
+
+func (c *rangeCursor) next() (string, bool, error) {
+	for {
+		e, err := c.cursor.next()
+		if err != nil || e == nil {
+			return "", false, err
+		}
+		if c.end != "" && e.key >= c.end {
+			return "", false, nil
+		}
+		if e.key >= c.start {
+			return e.key, true, nil
+		}
+	}
+}
+
+// scan reads the entries of the segment one by one starting at offset until
+// fn returns false or the segment ends.
+func (s *Segment) scan(offset int64, fn func(e *entry, offset int64) bool) error {
+	return s.scanTo(offset, math.MaxInt64, fn)
+}
+
+// scanTo is scan that stops at end, e.g. where the records written completely
+// end in the active segment.
+func (s *Segment) scanTo(offset, end int64, fn func(e *entry, offset int64) bool) error {
+	reader := bufio.NewReaderSize(io.NewSectionReader(s.file, offset, end-offset), bufSize)
+	for {
+		e, err := readEntry(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !fn(e, offset) {
+			return nil
+		}
+		offset += e.size()
+	}
+}
+
+// segmentCursor yields the entries of a segment in key order; next returns
+// nil once the segment is exhausted.
+type segmentCursor interface {
+	next() (*entry, error)
+}
+
+// hashCursor yields the keys of a hash-indexed segment in order, with either
+// the latest entry of every key or all of its entries.
+type hashCursor struct {
+	segment *Segment
+	keys    []string
+	offsets map[string][]int64
+}
+
+func newHashCursor(s *Segment, allVersions bool) (*hashCursor, error) {
+	offsets := make(map[string][]int64, len(s.index))
+	if allVersions {
+		if _, err := s.walk(func(k keyOffset) {
+			offsets[k.key] = append(offsets[k.key], k.offset)
+		}); err != nil {
+			return nil, err
+		}
+	} else {
+		for key, offset := range s.index {
+			offsets[key] = []int64{offset}
+		}
+	}
+
+	keys := make([]string, 0, len(offsets))
+	for key := range offsets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return &hashCursor{segment: s, keys: keys, offsets: offsets}, nil
+}
+
+func (c *hashCursor) next() (*entry, error) {
+	if len(c.keys) == 0 {
+		return nil, nil
+	}
+	key := c.keys[0]
+	offsets := c.offsets[key]
+	if len(offsets) == 1 {
+		c.keys = c.keys[1:]
+	} else {
+		c.offsets[key] = offsets[1:]
+	}
+	return c.segment.getFromSegment(offsets[0])
+}
+
+type fileCursor struct {
+	reader *bufio.Reader
+}
+
+func newFileCursor(s *Segment, offset int64) *fileCursor {
+	return &fileCursor{reader: bufio.NewReaderSize(s.reader(offset), bufSize)}
+}
+
+func (c *fileCursor) next() (*entry, error) {
+	e, err := readEntry(c.reader)
+	if err == io.EOF {
+		return nil, nil
+	}
+	return e, err
+}
+
+func newSegmentCursor(s *Segment, allVersions bool) (segmentCursor, error) {
+	if s.isSorted() {
+		return newFileCursor(s, fileHeaderSize), nil
+	}
+	return newHashCursor(s, allVersions)
+}
+
+// mergeSegments walks over the keys of all the sources in ascending order and
+// calls fn with the versions of each key, oldest first. Sources go from
+// oldest to newest. Unless allVersions is set, the hash-indexed sources
+// contribute only the latest version of a key.
+func mergeSegments(sources []*Segment, allVersions bool, fn func(versions []*entry) error) error {
+	cursors := make([]segmentCursor, len(sources))
+	heads := make([]*entry, len(sources))
+	for i, s := range sources {
+		var err error
+		if cursors[i], err = newSegmentCursor(s, allVersions); err != nil {
+			return err
+		}
+		if heads[i], err = cursors[i].next(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		first := -1
+		for i, head := range heads {
+			if head == nil {
+				continue
+			}
+			if first < 0 || head.key < heads[first].key {
+				first = i
+			}
+		}
+		if first < 0 {
+			return nil
+		}
+
+		key := heads[first].key
+		var versions []*entry
+		for i := range heads {
+			for heads[i] != nil && heads[i].key == key {
+				versions = append(versions, heads[i])
+				var err error
+				if heads[i], err = cursors[i].next(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := fn(versions); err != nil {
+			return err
+		}
+	}
+}
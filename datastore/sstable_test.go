@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_SortedSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const keys = 2000
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%05d", keys-i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(2 * time.Second)
+
+	checkKeys := func(t *testing.T) {
+		t.Helper()
+		for i := 0; i < keys; i++ {
+			value, err := db.Get(fmt.Sprintf("key%05d", keys-i))
+			if err != nil {
+				t.Fatalf("Cannot get key%05d: %s", keys-i, err)
+			}
+			assertEqual(t, value, fmt.Sprintf("value%d", i))
+		}
+		if _, err := db.Get("key99999"); err != ErrNotFound {
+			t.Errorf("Expected not found, got: %v", err)
+		}
+	}
+
+	t.Run("compaction writes sorted segment", func(t *testing.T) {
+		s := segmentsOf(db)[0]
+		if !s.isSorted() {
+			t.Fatal("Expected the compacted segment to be sorted")
+		}
+		if len(s.sparse.keys) < 2 || len(s.sparse.keys) >= s.sparse.count {
+			t.Errorf("Expected a sparse index, got %d keys for %d entries", len(s.sparse.keys), s.sparse.count)
+		}
+		checkKeys(t)
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 50000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		s := segmentsOf(db)[0]
+		if !s.isSorted() || s.index != nil {
+			t.Error("Expected the compacted segment to be recovered as sorted")
+		}
+		checkKeys(t)
+	})
+}
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		f.add(fmt.Sprintf("key%d", i))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("Expected key%d to be in the filter", i)
+		}
+		if f.mayContain(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("Too many false positives: %d", falsePositives)
+	}
+}
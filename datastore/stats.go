@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"time"
+)
+
+// Stats describes the data files and the load of a Db.
+//
+// A key is live if its latest version is neither deleted nor expired; it's
+// counted in the segment holding that version. The bytes of all the other
+// entries, including the older versions kept for History, are dead:
+// DeadBytesRatio is their part of the data in all the segments.
+type Stats struct {
+	Segments       []SegmentStats
+	Keys           int
+	DeadBytesRatio float64
+	// LastCompaction is when the last compaction finished, zero if none did.
+	LastCompaction time.Time
+	// Puts counts the writes since the Db was opened: puts, deletes and
+	// batches. Gets counts the values read by the Get methods, Type and
+	// iterators.
+	Puts uint64
+	Gets uint64
+}
+
+// SegmentStats describes a segment file, oldest first in Stats.Segments.
+type SegmentStats struct {
+	Number   int
+	Size     int64
+	LiveKeys int
+	Sorted   bool
+}
+
+// Stats takes the keys of the closed segments from their hints, so it only
+// reads the entries of the active segment and of the segments whose hint isn't
+// written yet.
+func (db *Db) Stats() (Stats, error) {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return Stats{}, ErrClosed
+	}
+	segments := make([]*Segment, len(db.segments))
+	copy(segments, db.segments)
+	generation := db.generation
+	active := db.outOffset
+	res := Stats{
+		LastCompaction: db.compaction.stats.LastFinished,
+		Puts:           db.puts.Load(),
+		Gets:           db.gets.Load(),
+	}
+	db.mu.RUnlock()
+
+	now := time.Now()
+	res.Segments = make([]SegmentStats, len(segments))
+	seen := make(map[string]struct{})
+	var total, live int64
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		end := s.outOffset
+		if i == len(segments)-1 {
+			end = active
+		}
+		latest, err := s.latestKeys(end, i == len(segments)-1)
+		if retry, err := db.readFailed(generation, err); retry {
+			// Compaction merged the segment meanwhile.
+			return db.Stats()
+		} else if err != nil {
+			return Stats{}, err
+		}
+
+		stats := SegmentStats{Number: s.number, Size: end, Sorted: s.isSorted()}
+		for key, k := range latest {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if k.isLive(now) {
+				stats.LiveKeys++
+				live += k.size
+			}
+		}
+		res.Segments[i] = stats
+		res.Keys += stats.LiveKeys
+		total += end - fileHeaderSize
+	}
+	if total > 0 {
+		res.DeadBytesRatio = float64(total-live) / float64(total)
+	}
+	return res, nil
+}
+
+// latestKeys returns the latest record of every key in the segment, taken from
+// its hint unless it's the active one or the hint is missing, in which case
+// the entries are read up to end.
+func (s *Segment) latestKeys(end int64, active bool) (map[string]keyOffset, error) {
+	res := make(map[string]keyOffset)
+	add := func(k keyOffset) {
+		res[k.key] = k
+	}
+	if !active {
+		if _, err := s.readHint(add); err == nil {
+			return res, nil
+		}
+		res = make(map[string]keyOffset)
+	}
+	err := s.scanTo(fileHeaderSize, end, func(e *entry, _ int64) bool {
+		for _, k := range e.keyOffsets() {
+			add(k)
+		}
+		return true
+	})
+	return res, err
+}
@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 126, WithCompactionThreshold(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key1", "value3")
+	db.Delete("key2")
+	db.PutBatch(map[string]string{"key3": "value4", "key4": "value5"})
+	db.PutWithTTL("key5", "value6", time.Millisecond)
+	db.Get("key1")
+	db.Get("key2")
+	time.Sleep(10 * time.Millisecond)
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, stats.Keys, 3)
+	assertEqual(t, stats.Puts, uint64(6))
+	assertEqual(t, stats.Gets, uint64(2))
+	if !stats.LastCompaction.IsZero() {
+		t.Errorf("Unexpected compaction at %s", stats.LastCompaction)
+	}
+	if stats.DeadBytesRatio <= 0 || stats.DeadBytesRatio >= 1 {
+		t.Errorf("Unexpected dead bytes ratio: %f", stats.DeadBytesRatio)
+	}
+
+	segments := segmentsOf(db)
+	assertEqual(t, len(stats.Segments), len(segments))
+	liveKeys := 0
+	for i, s := range stats.Segments {
+		info, err := os.Stat(segments[i].filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, s.Number, segments[i].number)
+		assertEqual(t, s.Size, info.Size())
+		liveKeys += s.LiveKeys
+	}
+	assertEqual(t, liveKeys, stats.Keys)
+
+	db.PutWithTTL("key6", "value7", 300*time.Millisecond)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, stats.Keys, 4)
+	assertEqual(t, stats.DeadBytesRatio, 0.0)
+	assertEqual(t, stats.Segments[0].Sorted, true)
+	assertEqual(t, stats.Segments[0].LiveKeys, 4)
+	if stats.LastCompaction.IsZero() {
+		t.Error("Expected the compaction time")
+	}
+
+	// The keys of the compacted segment are counted from its hint, so its
+	// values aren't read.
+	compacted := segmentsOf(db)[0].filePath
+	data, err := ioutil.ReadFile(compacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := fileHeaderSize; i < len(data); i++ {
+		data[i] = 0
+	}
+	if err := ioutil.WriteFile(compacted, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	stats, err = db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, stats.Keys, 3)
+	assertEqual(t, stats.Segments[0].LiveKeys, 3)
+}
@@ -0,0 +1,144 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrTxnConflict is returned when a key read by a transaction was written
+	// after the transaction began. It matches ErrConflict with errors.Is.
+	ErrTxnConflict = fmt.Errorf("%w: a key read by the transaction has changed", ErrConflict)
+	ErrTxnDone     = errors.New("transaction is already committed")
+)
+
+// Txn reads and writes keys as a single unit. Reads see the writes of the
+// transaction itself; the writes are kept in memory until Commit, which
+// writes all of them as a single batch only if none of the keys read has been
+// written since Begin. A Txn must not be used from several goroutines.
+type Txn struct {
+	db     *Db
+	start  uint64
+	reads  map[string]struct{}
+	writes map[string]entry
+	done   bool
+}
+
+// Begin starts a transaction. There's nothing to release if it's abandoned
+// without Commit.
+func (db *Db) Begin() *Txn {
+	return &Txn{
+		db:     db,
+		start:  db.Seq(),
+		reads:  make(map[string]struct{}),
+		writes: make(map[string]entry),
+	}
+}
+
+// Get returns the value written by the transaction or the one the key holds.
+// It fails with ErrTxnConflict right away if the key has changed since Begin,
+// since the transaction couldn't commit anyway.
+func (tx *Txn) Get(key string) (string, error) {
+	if tx.done {
+		return "", ErrTxnDone
+	}
+	if e, ok := tx.writes[key]; ok {
+		if e.isTombstone() {
+			return "", ErrNotFound
+		}
+		return e.value, nil
+	}
+
+	e, err := tx.db.lookup(key)
+	if err != nil {
+		return "", err
+	}
+	if e != nil && e.seq > tx.start {
+		return "", ErrTxnConflict
+	}
+	tx.reads[key] = struct{}{}
+	if e == nil || e.isTombstone() || e.isExpired(time.Now()) {
+		return "", ErrNotFound
+	}
+	if err := checkType(e, TypeString); err != nil {
+		return "", err
+	}
+	if err := e.decompress(); err != nil {
+		return "", err
+	}
+	return e.value, nil
+}
+
+func (tx *Txn) Put(key, value string) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.writes[key] = entry{
+		key:       key,
+		value:     value,
+		valueType: TypeString,
+	}
+	return nil
+}
+
+func (tx *Txn) Delete(key string) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.writes[key] = entry{
+		key:  key,
+		kind: kindDelete,
+	}
+	return nil
+}
+
+// Commit writes the changes of the transaction atomically, or returns
+// ErrTxnConflict without writing anything if a key it read has changed. The
+// check and the write are done by the put goroutine, so no other write can
+// come between them.
+func (tx *Txn) Commit() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.done = true
+	if len(tx.writes) == 0 {
+		return tx.validate()
+	}
+
+	keys := make([]string, 0, len(tx.writes))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	entries := make([]entry, len(keys))
+	for i, key := range keys {
+		e := tx.writes[key]
+		e.compress(tx.db.compression)
+		entries[i] = e
+	}
+	return tx.db.submit(putOp{prepare: func() (entry, error) {
+		if err := tx.validate(); err != nil {
+			return entry{}, err
+		}
+		return newBatchEntry(entries), nil
+	}})
+}
+
+// validate checks that none of the keys read was written after Begin. A key
+// deleted after Begin and then dropped by compaction can't be told from one
+// that never existed, which is only possible for long transactions.
+func (tx *Txn) validate() error {
+	for key := range tx.reads {
+		e, err := tx.db.lookup(key)
+		if err != nil {
+			return err
+		}
+		if e != nil && e.seq > tx.start {
+			return ErrTxnConflict
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDb_Txn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("stock", "10")
+	db.Put("orders", "0")
+
+	t.Run("commit", func(t *testing.T) {
+		tx := db.Begin()
+		stock, err := tx.Get("stock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, stock, "10")
+		tx.Put("stock", "9")
+		tx.Put("order1", "pending")
+		tx.Delete("orders")
+
+		// Reads see the writes of the transaction, others don't see them yet.
+		stock, _ = tx.Get("stock")
+		assertEqual(t, stock, "9")
+		if _, err := tx.Get("orders"); err != ErrNotFound {
+			t.Errorf("Expected deleted key, got: %v", err)
+		}
+		value, _ := db.Get("stock")
+		assertEqual(t, value, "10")
+
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		value, _ = db.Get("stock")
+		assertEqual(t, value, "9")
+		value, _ = db.Get("order1")
+		assertEqual(t, value, "pending")
+		if _, err := db.Get("orders"); err != ErrNotFound {
+			t.Errorf("Expected deleted key, got: %v", err)
+		}
+		if err := tx.Commit(); err != ErrTxnDone {
+			t.Errorf("Expected a committed transaction, got: %v", err)
+		}
+	})
+
+	t.Run("conflict on commit", func(t *testing.T) {
+		tx := db.Begin()
+		tx.Get("stock")
+		tx.Get("missing")
+		tx.Put("stock", "8")
+
+		db.Put("missing", "now exists")
+		if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+			t.Fatalf("Expected a conflict, got: %v", err)
+		}
+		value, _ := db.Get("stock")
+		assertEqual(t, value, "9")
+	})
+
+	t.Run("conflict on read", func(t *testing.T) {
+		tx := db.Begin()
+		db.Put("stock", "7")
+		if _, err := tx.Get("stock"); err != ErrTxnConflict {
+			t.Errorf("Expected a conflict, got: %v", err)
+		}
+	})
+
+	t.Run("blind writes don't conflict", func(t *testing.T) {
+		tx := db.Begin()
+		tx.Put("stock", "5")
+		db.Put("stock", "6")
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		value, _ := db.Get("stock")
+		assertEqual(t, value, "5")
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		db.Put("counter", "0")
+		const workers, increments = 4, 25
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < increments; {
+					tx := db.Begin()
+					value, err := tx.Get("counter")
+					if err == nil {
+						n, _ := strconv.Atoi(value)
+						tx.Put("counter", fmt.Sprint(n+1))
+						err = tx.Commit()
+					}
+					if err == nil {
+						i++
+					} else if !errors.Is(err, ErrConflict) {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, _ := db.Get("counter")
+		assertEqual(t, value, fmt.Sprint(workers*increments))
+	})
+}
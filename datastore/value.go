@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ValueType tells how the value of an entry should be interpreted.
+type ValueType byte
+
+const (
+	TypeString ValueType = iota
+	TypeInt64
+	TypeBytes
+)
+
+var ErrTypeMismatch = fmt.Errorf("value type mismatch")
+
+var valueTypeNames = map[ValueType]string{
+	TypeString: "string",
+	TypeInt64:  "int64",
+	TypeBytes:  "bytes",
+}
+
+func (t ValueType) String() string {
+	if name, ok := valueTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+// ParseValueType converts a type name back to ValueType. An empty name means TypeString.
+func ParseValueType(name string) (ValueType, error) {
+	if name == "" {
+		return TypeString, nil
+	}
+	for t, n := range valueTypeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown value type %q", name)
+}
+
+func encodeInt64(v int64) string {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(v))
+	return string(buf[:])
+}
+
+func decodeInt64(s string) (int64, error) {
+	if len(s) != 8 {
+		return 0, fmt.Errorf("int64 value has %d bytes", len(s))
+	}
+	return int64(binary.LittleEndian.Uint64([]byte(s))), nil
+}
+
+func checkType(e *entry, expected ValueType) error {
+	if e.valueType != expected {
+		return fmt.Errorf("%w: key %q holds %s, not %s", ErrTypeMismatch, e.key, e.valueType, expected)
+	}
+	return nil
+}
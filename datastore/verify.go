@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Corruption describes a damaged record found by Verify.
+type Corruption struct {
+	Path   string
+	Offset int64
+	Reason string
+	// Torn is set when the record is cut off by the end of the file, which
+	// is what an interrupted write leaves behind.
+	Torn bool
+}
+
+func (c Corruption) String() string {
+	return fmt.Sprintf("%s: offset %d: %s", c.Path, c.Offset, c.Reason)
+}
+
+// Verify scans every segment in dir and checks the framing and the checksum of
+// each record. It doesn't need the database to be open.
+func Verify(dir string) ([]Corruption, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Corruption
+	for _, n := range segmentNumbers(files) {
+		found, err := verifySegment(segmentPath(dir, n))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, found...)
+	}
+	return res, nil
+}
+
+// Repair truncates a torn record at the end of the last segment, so the
+// database can be opened again. It returns what Verify found before the repair.
+// Damage anywhere else is reported but left untouched.
+func Repair(dir string) ([]Corruption, error) {
+	found, err := Verify(dir)
+	if err != nil || len(found) == 0 {
+		return found, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	numbers := segmentNumbers(files)
+	lastPath := segmentPath(dir, numbers[len(numbers)-1])
+
+	last := found[len(found)-1]
+	if last.Torn && last.Path == lastPath {
+		if err := os.Truncate(lastPath, last.Offset); err != nil {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
+func verifySegment(path string) ([]Corruption, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := readFileHeader(f)
+	if err != nil {
+		return []Corruption{{Path: path, Reason: err.Error(), Torn: true}}, nil
+	}
+	if h.version > formatVersion {
+		return nil, unsupportedVersion(path, h.version)
+	}
+	entryHeaderSize := h.entryHeaderSize()
+
+	var res []Corruption
+	offset := h.dataOffset()
+	in := bufio.NewReaderSize(io.NewSectionReader(f, offset, math.MaxInt64-offset), bufSize)
+	for {
+		header, err := in.Peek(entryHeaderSize)
+		if err == io.EOF && len(header) == 0 {
+			return res, nil
+		} else if err == io.EOF {
+			return append(res, Corruption{Path: path, Offset: offset, Reason: "truncated header", Torn: true}), nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !validRecordSizeFor(header, entryHeaderSize) {
+			// The length of the record is unknown, so the rest of the file can't be framed.
+			return append(res, Corruption{Path: path, Offset: offset, Reason: "invalid record size"}), nil
+		}
+
+		data := make([]byte, binary.LittleEndian.Uint32(header))
+		n, err := io.ReadFull(in, data)
+		if err == io.ErrUnexpectedEOF {
+			return append(res, Corruption{Path: path, Offset: offset, Reason: "truncated record", Torn: true}), nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err := verifySum(data); err != nil {
+			res = append(res, Corruption{Path: path, Offset: offset, Reason: err.Error()})
+		}
+		offset += int64(n)
+	}
+}
@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	outPath := db.outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	record := entry{key: "key1", value: "value1"}
+	size := int64(len(record.Encode()))
+
+	t.Run("clean segments", func(t *testing.T) {
+		found, err := Verify(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, len(found), 0)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		file, err := os.OpenFile(outPath, os.O_RDWR, 0o655)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.WriteAt([]byte{0x59}, fileHeaderSize+size+headerSize)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := Verify(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 {
+			t.Fatalf("Expected 1 corruption, got %v", found)
+		}
+		assertEqual(t, found[0].Offset, fileHeaderSize+size)
+		assertEqual(t, found[0].Torn, false)
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		file, err := os.OpenFile(outPath, os.O_APPEND|os.O_WRONLY, 0o655)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.Write(record.Encode()[:size/2])
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewDb(dir, 250); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected corrupted record error, got: %v", err)
+		}
+
+		found, err := Repair(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 2 {
+			t.Fatalf("Expected 2 corruptions, got %v", found)
+		}
+		assertEqual(t, found[1].Offset, fileHeaderSize+2*size)
+		assertEqual(t, found[1].Torn, true)
+
+		info, err := os.Stat(outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, info.Size(), fileHeaderSize+2*size)
+
+		db, err := NewDb(dir, 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		value, _ := db.Get("key1")
+		assertEqual(t, value, "value1")
+	})
+}
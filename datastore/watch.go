@@ -0,0 +1,290 @@
+package datastore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// watchBufferSize is the number of events a Watcher may fall behind the
+// writes before it's stopped with ErrWatchOverflow.
+const watchBufferSize = 1024
+
+// ErrWatchOverflow is reported by a Watcher whose reader didn't keep up with
+// the writes. It can start again from the last event it received.
+var ErrWatchOverflow = errors.New("watcher fell behind the writes")
+
+// Event is a change of a key, with the value written or Deleted set.
+type Event struct {
+	Key string
+	Version
+}
+
+// Watcher delivers the changes of the keys with a prefix on C, in the order
+// of their sequence numbers. C is closed when the Watcher is stopped or fails;
+// Err tells which.
+type Watcher struct {
+	C <-chan Event
+
+	db     *Db
+	prefix string
+	out    chan Event
+	live   chan Event
+	stop   chan struct{}
+
+	mu       sync.Mutex
+	stopped  bool
+	overflow bool
+	err      error
+}
+
+// Watch returns a Watcher of the changes made from now on to the keys with
+// the prefix. Stop must be called when it's no longer needed.
+func (db *Db) Watch(prefix string) *Watcher {
+	w, _ := db.WatchFrom(prefix, db.Seq())
+	return w
+}
+
+// WatchFrom is like Watch but first delivers the changes made after the
+// write with the sequence number seq, e.g. the last one a reader got before
+// it reconnected. It fails with ErrLogTruncated when compaction has merged
+// some of those changes.
+func (db *Db) WatchFrom(prefix string, seq uint64) (*Watcher, error) {
+	w := &Watcher{
+		db:     db,
+		prefix: prefix,
+		out:    make(chan Event),
+		live:   make(chan Event, watchBufferSize),
+		stop:   make(chan struct{}),
+	}
+	w.C = w.out
+
+	// The watcher is registered before the replay, so the writes after upto
+	// are delivered live and only the ones before it are replayed.
+	db.watchMu.Lock()
+	db.watchers[w] = struct{}{}
+	db.watchMu.Unlock()
+
+	db.mu.RLock()
+	upto := db.seq
+	start := db.replayStart(seq)
+	db.mu.RUnlock()
+	if seq < upto && start < 0 {
+		w.Stop()
+		return nil, ErrLogTruncated
+	}
+
+	go w.run(seq, upto)
+	return w, nil
+}
+
+// Stop stops delivering events and closes C.
+func (w *Watcher) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.stop)
+	}
+	w.db.watchMu.Lock()
+	delete(w.db.watchers, w)
+	w.db.watchMu.Unlock()
+}
+
+// Err returns why C was closed: nil after Stop, ErrWatchOverflow or an error
+// reading the segments.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *Watcher) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+	w.Stop()
+}
+
+func (w *Watcher) run(seq, upto uint64) {
+	defer close(w.out)
+
+	if err := w.db.replay(w.prefix, seq, upto, w.send); err != nil {
+		w.fail(err)
+		return
+	}
+	for {
+		select {
+		case e, ok := <-w.live:
+			if !ok {
+				w.fail(ErrWatchOverflow)
+				return
+			}
+			if e.Seq <= upto || e.Seq <= seq {
+				// Replayed or written before the start. The events of a
+				// batch share a sequence number, so it can't be compared
+				// with the last event sent.
+				continue
+			}
+			if !w.send(e) {
+				return
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// send delivers the event unless the watcher is stopped meanwhile.
+func (w *Watcher) send(e Event) bool {
+	select {
+	case w.out <- e:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
+
+// publish hands the entry written by the put goroutine to the watchers. A
+// watcher that has no room for it is stopped rather than delay the writes.
+func (db *Db) publish(e entry) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if len(db.watchers) == 0 {
+		return
+	}
+
+	events, err := entryEvents(e)
+	for w := range db.watchers {
+		if err != nil {
+			go w.fail(err)
+			continue
+		}
+		for _, event := range events {
+			if !strings.HasPrefix(event.Key, w.prefix) {
+				continue
+			}
+			if w.overflow {
+				break
+			}
+			select {
+			case w.live <- event:
+			default:
+				w.overflow = true
+				close(w.live)
+			}
+		}
+	}
+}
+
+// entryEvents lists the changes written by an entry with decompressed values.
+func entryEvents(e entry) ([]Event, error) {
+	entries := []entry{e}
+	if e.kind == kindBatch {
+		entries = e.batchEntries()
+	}
+	res := make([]Event, 0, len(entries))
+	for _, inner := range entries {
+		if err := inner.decompress(); err != nil {
+			return nil, err
+		}
+		res = append(res, Event{Key: inner.key, Version: inner.version()})
+	}
+	return res, nil
+}
+
+// replayStart returns the index of the newest segment that was created
+// before the write with the sequence number seq, so all the later writes are
+// in it or in the segments after it. It's -1 if they were compacted. The
+// caller must hold db.mu.
+func (db *Db) replayStart(seq uint64) int {
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		if db.segments[i].startSeq <= seq {
+			return i
+		}
+	}
+	return -1
+}
+
+// replay calls send with the changes of the keys with the prefix made after
+// the write seq up to the write upto, read from the segments. It stops early
+// when send returns false.
+//
+// A replica keeps the sequence numbers of its primary, which aren't in order
+// when it applied a compacted segment, so the segments are read whole and the
+// changes sorted before they are sent.
+func (db *Db) replay(prefix string, seq, upto uint64, send func(e Event) bool) error {
+	if seq >= upto {
+		return nil
+	}
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return ErrClosed
+	}
+	generation := db.generation
+	start := db.replayStart(seq)
+	var segments []*Segment
+	if start >= 0 {
+		segments = append(segments, db.segments[start:]...)
+	}
+	active := db.outOffset
+	db.mu.RUnlock()
+	if start < 0 {
+		return ErrLogTruncated
+	}
+
+	var events []Event
+	for i, s := range segments {
+		if s.isSorted() && s.startSeq <= seq {
+			// Written by compaction, so all its entries are older. Only the
+			// hint of a compacted segment marks it as sorted after a restart.
+			continue
+		}
+		end := active
+		if i < len(segments)-1 {
+			end = s.outOffset
+		}
+		var scanErr error
+		err := s.scanTo(fileHeaderSize, end, func(e *entry, _ int64) bool {
+			if e.seq <= seq || e.seq > upto {
+				return true
+			}
+			var changes []Event
+			if changes, scanErr = entryEvents(*e); scanErr != nil {
+				return false
+			}
+			for _, event := range changes {
+				if strings.HasPrefix(event.Key, prefix) {
+					events = append(events, event)
+				}
+			}
+			return true
+		})
+		retry, err := db.readFailed(generation, err)
+		if retry {
+			// Compaction merged the segment meanwhile, so read the
+			// segments that replaced it.
+			return db.replay(prefix, seq, upto, send)
+		}
+		if err == nil {
+			err = scanErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Seq < events[j].Seq
+	})
+	for _, event := range events {
+		if !send(event) {
+			return nil
+		}
+	}
+	return nil
+}
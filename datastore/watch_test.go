@@ -0,0 +1,201 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Rolled over often but not compacted, so the changes stay available.
+	db, err := NewDb(dir, 126, WithCompactionThreshold(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("live changes", func(t *testing.T) {
+		w := db.Watch("user:")
+		defer w.Stop()
+
+		db.Put("user:1", "alice")
+		db.Put("other", "x")
+		db.PutBatch(map[string]string{"user:2": "bob", "x": "y"})
+		db.Delete("user:1")
+
+		e := nextEvent(t, w)
+		assertEqual(t, e.Key, "user:1")
+		assertEqual(t, e.Value, "alice")
+		e = nextEvent(t, w)
+		assertEqual(t, e.Key, "user:2")
+		assertEqual(t, e.Value, "bob")
+		e = nextEvent(t, w)
+		assertEqual(t, e.Key, "user:1")
+		assertEqual(t, e.Deleted, true)
+		assertEqual(t, e.Seq, db.Seq())
+	})
+
+	t.Run("resume from a sequence number", func(t *testing.T) {
+		from := db.Seq()
+		// Enough writes to roll over several segments.
+		for i := 0; i < 5; i++ {
+			db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		}
+
+		w, err := db.WatchFrom("key", from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		for i := 0; i < 5; i++ {
+			e := nextEvent(t, w)
+			assertEqual(t, e.Key, fmt.Sprintf("key%d", i))
+			assertEqual(t, e.Seq, from+uint64(i)+1)
+		}
+		db.Put("key5", "value5")
+		assertEqual(t, nextEvent(t, w).Key, "key5")
+	})
+
+	t.Run("batches and transactions", func(t *testing.T) {
+		w := db.Watch("multi:")
+		defer w.Stop()
+
+		db.PutBatch(map[string]string{"multi:a": "1", "multi:b": "2", "multi:c": "3"})
+		tx := db.Begin()
+		tx.Put("multi:x", "4")
+		tx.Put("multi:y", "5")
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for i := 0; i < 5; i++ {
+			keys = append(keys, nextEvent(t, w).Key)
+		}
+		sort.Strings(keys)
+		assertEqual(t, strings.Join(keys, ","), "multi:a,multi:b,multi:c,multi:x,multi:y")
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		w := db.Watch("")
+		w.Stop()
+		if _, ok := <-w.C; ok {
+			t.Error("Expected C to be closed")
+		}
+		if err := w.Err(); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		w := db.Watch("")
+		defer w.Stop()
+		for i := 0; i < watchBufferSize+10; i++ {
+			db.Put("key", "value")
+		}
+		for range w.C {
+		}
+		if err := w.Err(); err != ErrWatchOverflow {
+			t.Errorf("Expected ErrWatchOverflow, got: %v", err)
+		}
+	})
+}
+
+func TestDb_WatchFromCompacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		db.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	time.Sleep(2 * time.Second)
+
+	if !segmentsOf(db)[0].isSorted() {
+		t.Fatal("Expected the segments to be compacted")
+	}
+	if _, err := db.WatchFrom("", 1); err != ErrLogTruncated {
+		t.Errorf("Expected ErrLogTruncated, got: %v", err)
+	}
+	w, err := db.WatchFrom("", db.Seq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	db.Put("key", "value")
+	assertEqual(t, nextEvent(t, w).Key, "key")
+}
+
+func TestDb_WatchFromAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The keys go in order, so the closed segments look sorted, but none of
+	// them is compacted.
+	db, err := NewDb(dir, 300, WithCompactionThreshold(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		db.Put(fmt.Sprintf("key%02d", i), "value")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 300, WithCompactionThreshold(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(segmentsOf(db)) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(segmentsOf(db)))
+	}
+
+	w, err := db.WatchFrom("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	for i := 1; i < 12; i++ {
+		e := nextEvent(t, w)
+		assertEqual(t, e.Key, fmt.Sprintf("key%02d", i))
+		assertEqual(t, e.Seq, uint64(i)+1)
+	}
+}
+
+func nextEvent(t *testing.T, w *Watcher) Event {
+	t.Helper()
+	select {
+	case e, ok := <-w.C:
+		if !ok {
+			t.Fatalf("The watcher stopped: %v", w.Err())
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("No event")
+	}
+	return Event{}
+}
@@ -0,0 +1,87 @@
+// Package sharding spreads the keys of the db service over several db nodes
+// with consistent hashing.
+package sharding
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points each node gets on the ring. More
+// points spread the keys more evenly.
+const DefaultVirtualNodes = 64
+
+// Ring maps keys to nodes. Adding a node moves only the keys that the new node
+// takes over. A Ring is never changed after it's built, so it can be shared.
+type Ring struct {
+	vnodes int
+	nodes  []string
+	points []uint32
+	owners map[uint32]string
+}
+
+func NewRing(vnodes int, nodes ...string) *Ring {
+	r := &Ring{vnodes: vnodes, owners: make(map[uint32]string)}
+	for _, node := range nodes {
+		r.add(node)
+	}
+	return r
+}
+
+func (r *Ring) add(node string) {
+	r.nodes = append(r.nodes, node)
+	for i := 0; i < r.vnodes; i++ {
+		point := hash(node + "#" + strconv.Itoa(i))
+		if _, taken := r.owners[point]; taken {
+			// Collisions are rare; the first node keeps the point.
+			continue
+		}
+		r.owners[point] = node
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+}
+
+// With returns a copy of the ring with one more node.
+func (r *Ring) With(node string) *Ring {
+	return NewRing(r.vnodes, append(r.Nodes(), node)...)
+}
+
+// Owner returns the node holding the key, or "" for an empty ring.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+func (r *Ring) Has(node string) bool {
+	for _, n := range r.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// hash spreads similar keys, such as key1 and key2, far apart on the ring,
+// which CRC32 doesn't.
+func hash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:])
+}
@@ -0,0 +1,54 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing_Owner(t *testing.T) {
+	nodes := []string{"http://db1:8083", "http://db2:8083", "http://db3:8083"}
+	ring := NewRing(DefaultVirtualNodes, nodes...)
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := ring.Owner(key)
+		if owner != ring.Owner(key) {
+			t.Fatalf("Owner of %s is not stable", key)
+		}
+		counts[owner]++
+	}
+	for _, node := range nodes {
+		if counts[node] < 500 {
+			t.Errorf("Node %s owns only %d of 3000 keys", node, counts[node])
+		}
+	}
+
+	if owner := NewRing(DefaultVirtualNodes).Owner("key"); owner != "" {
+		t.Errorf("Expected no owner on an empty ring, got %s", owner)
+	}
+}
+
+func TestRing_With(t *testing.T) {
+	ring := NewRing(DefaultVirtualNodes, "http://db1:8083", "http://db2:8083")
+	next := ring.With("http://db3:8083")
+	if ring.Has("http://db3:8083") || !next.Has("http://db3:8083") {
+		t.Fatal("With must return a new ring and leave the old one as is")
+	}
+
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before, after := ring.Owner(key), next.Owner(key)
+		if before == after {
+			continue
+		}
+		if after != "http://db3:8083" {
+			t.Fatalf("Key %s moved from %s to %s instead of the new node", key, before, after)
+		}
+		moved++
+	}
+	if moved == 0 {
+		t.Error("Expected some keys to move to the new node")
+	}
+}
@@ -0,0 +1,323 @@
+package sharding
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyLocks       = 64
+	migrationPage  = 100
+	migrationRetry = time.Second
+)
+
+// ErrMigrating is returned by AddNode while keys still move to the previous node.
+var ErrMigrating = errors.New("a node is being added already")
+
+// item is a value as GET /db/{key} of a node returns it; TTL is the number
+// of seconds left until a value written with a TTL expires.
+type item struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Type  string `json:"type"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+// putBody is the body of POST /db/{key} of a node.
+type putBody struct {
+	Value string `json:"value"`
+	Type  string `json:"type"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+type listPage struct {
+	Items  []item `json:"items"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Status describes the nodes of a Router and the progress of adding one.
+type Status struct {
+	Nodes     []string `json:"nodes"`
+	Adding    string   `json:"adding,omitempty"`
+	Migrated  int      `json:"migrated"`
+	LastError string   `json:"lastError,omitempty"`
+}
+
+// Router forwards /db/{key} requests to the node owning the key. While a node
+// is being added, a key that moves to it is copied there and deleted from its
+// old node before any request for it is forwarded, both by the background
+// migration and on demand, so all the requests see a single copy of the key.
+// Only one Router may serve a set of nodes.
+type Router struct {
+	client *http.Client
+	// statePath is the file the ring is saved to, see OpenRouter.
+	statePath string
+
+	// mu is held for reading by every forwarded request, so the ring can't
+	// change while one is in flight.
+	mu sync.RWMutex
+	// ring owns all the keys except those that next assigns to the node being added.
+	ring *Ring
+	next *Ring
+
+	locks [keyLocks]sync.Mutex
+
+	statusMu  sync.Mutex
+	adding    string
+	migrated  int
+	lastError error
+}
+
+func NewRouter(client *http.Client, nodes ...string) *Router {
+	return &Router{
+		client: client,
+		ring:   NewRing(DefaultVirtualNodes, nodes...),
+	}
+}
+
+func (rt *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	key := strings.TrimPrefix(req.URL.Path, "/db/")
+	if key == "" || key == "_batch" || key == "_watch" || key == req.URL.Path {
+		// Listings, batches and change feeds would span several nodes.
+		rw.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	// The history of a key is kept by the node owning the key.
+	key = strings.TrimSuffix(key, "/history")
+
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	owner := rt.ring.Owner(key)
+	if rt.next != nil && rt.next.Owner(key) != owner {
+		newOwner := rt.next.Owner(key)
+		lock := rt.lockFor(key)
+		lock.Lock()
+		defer lock.Unlock()
+		if err := rt.moveKey(key, owner, newOwner); err != nil {
+			log.Printf("Cannot move %s to %s: %s", key, newOwner, err)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		owner = newOwner
+	}
+	rt.forward(rw, req, owner)
+}
+
+func (rt *Router) lockFor(key string) *sync.Mutex {
+	return &rt.locks[hash(key)%keyLocks]
+}
+
+func (rt *Router) forward(rw http.ResponseWriter, req *http.Request, node string) {
+	target, err := url.Parse(node)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fwdRequest := req.Clone(req.Context())
+	fwdRequest.RequestURI = ""
+	fwdRequest.URL.Scheme = target.Scheme
+	fwdRequest.URL.Host = target.Host
+	fwdRequest.Host = target.Host
+
+	resp, err := rt.client.Do(fwdRequest)
+	if err != nil {
+		log.Printf("Failed to get response from %s: %s", node, err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	rw.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(rw, resp.Body); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+// moveKey copies the key from one node to another and deletes it from the
+// first one, unless it was moved already. The caller must hold the lock of
+// the key.
+func (rt *Router) moveKey(key, from, to string) error {
+	resp, err := rt.client.Get(from + "/db/" + url.PathEscape(key))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// Not there or moved already.
+		return nil
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", from, resp.Status)
+	}
+	var value item
+	if err := json.NewDecoder(resp.Body).Decode(&value); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(putBody{Value: value.Value, Type: value.Type, TTL: value.TTL})
+	if err != nil {
+		return err
+	}
+	if err := rt.expect(http.MethodPost, to+"/db/"+url.PathEscape(key), body, http.StatusCreated); err != nil {
+		return err
+	}
+	if err := rt.expect(http.MethodDelete, from+"/db/"+url.PathEscape(key), nil, http.StatusOK); err != nil {
+		return err
+	}
+	rt.statusMu.Lock()
+	rt.migrated++
+	rt.statusMu.Unlock()
+	return nil
+}
+
+func (rt *Router) expect(method, target string, body []byte, status int) error {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != status {
+		return fmt.Errorf("%s %s responded with %s", method, target, resp.Status)
+	}
+	return nil
+}
+
+// AddNode puts a new node on the ring and moves the keys it takes over in the
+// background. Requests keep being served meanwhile.
+func (rt *Router) AddNode(node string) error {
+	rt.mu.Lock()
+	if rt.next != nil {
+		rt.mu.Unlock()
+		return ErrMigrating
+	}
+	if rt.ring.Has(node) {
+		rt.mu.Unlock()
+		return fmt.Errorf("%s is on the ring already", node)
+	}
+	rt.next = rt.ring.With(node)
+	sources := rt.ring.Nodes()
+	if err := rt.save(routerState{Nodes: sources, Adding: node}); err != nil {
+		rt.next = nil
+		rt.mu.Unlock()
+		return fmt.Errorf("cannot save the ring: %w", err)
+	}
+	rt.mu.Unlock()
+
+	rt.statusMu.Lock()
+	rt.adding, rt.migrated, rt.lastError = node, 0, nil
+	rt.statusMu.Unlock()
+
+	go rt.migrate(sources)
+	return nil
+}
+
+// migrate moves the keys that changed their owner from every source node,
+// retrying until it succeeds, and then switches to the new ring.
+func (rt *Router) migrate(sources []string) {
+	rt.mu.RLock()
+	next := rt.next
+	rt.mu.RUnlock()
+
+	for _, node := range sources {
+		for {
+			err := rt.migrateNode(node, next)
+			rt.statusMu.Lock()
+			rt.lastError = err
+			rt.statusMu.Unlock()
+			if err == nil {
+				break
+			}
+			log.Printf("Migration from %s failed, retrying: %s", node, err)
+			time.Sleep(migrationRetry)
+		}
+	}
+
+	rt.mu.Lock()
+	rt.ring, rt.next = next, nil
+	err := rt.save(routerState{Nodes: next.Nodes()})
+	rt.mu.Unlock()
+	if err != nil {
+		// The saved state still lists the node as being added, so the
+		// migration is repeated after a restart, which is harmless.
+		log.Printf("Cannot save the ring: %s", err)
+	}
+
+	rt.statusMu.Lock()
+	rt.adding = ""
+	rt.statusMu.Unlock()
+}
+
+func (rt *Router) migrateNode(node string, next *Ring) error {
+	cursor := ""
+	for {
+		query := url.Values{}
+		query.Set("limit", fmt.Sprint(migrationPage))
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		resp, err := rt.client.Get(node + "/db/?" + query.Encode())
+		if err != nil {
+			return err
+		}
+		var page listPage
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s responded with %s", node, resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, it := range page.Items {
+			owner := next.Owner(it.Key)
+			if owner == node {
+				continue
+			}
+			lock := rt.lockFor(it.Key)
+			lock.Lock()
+			err := rt.moveKey(it.Key, node, owner)
+			lock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		if page.Cursor == "" {
+			return nil
+		}
+		cursor = page.Cursor
+	}
+}
+
+func (rt *Router) Status() Status {
+	rt.mu.RLock()
+	nodes := rt.ring.Nodes()
+	rt.mu.RUnlock()
+
+	rt.statusMu.Lock()
+	defer rt.statusMu.Unlock()
+	res := Status{Nodes: nodes, Adding: rt.adding, Migrated: rt.migrated}
+	if rt.lastError != nil {
+		res.LastError = rt.lastError.Error()
+	}
+	return res
+}
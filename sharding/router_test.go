@@ -0,0 +1,276 @@
+package sharding
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode implements the /db/ API of a db node over a map. TTLs are kept
+// as they were written and never expire.
+type fakeNode struct {
+	mu     sync.Mutex
+	values map[string]string
+	ttls   map[string]int64
+}
+
+func (n *fakeNode) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := strings.TrimPrefix(req.URL.Path, "/db/")
+	switch {
+	case req.Method == http.MethodGet && key == "":
+		var keys []string
+		for k := range n.values {
+			if k > req.URL.Query().Get("cursor") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		var page listPage
+		for _, k := range keys {
+			if len(page.Items) == limit {
+				page.Cursor = page.Items[limit-1].Key
+				break
+			}
+			page.Items = append(page.Items, item{Key: k, Value: n.values[k], Type: "string"})
+		}
+		_ = json.NewEncoder(rw).Encode(page)
+	case req.Method == http.MethodGet:
+		value, ok := n.values[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(item{Key: key, Value: value, Type: "string", TTL: n.ttls[key]})
+	case req.Method == http.MethodPost:
+		var body putBody
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n.values[key] = body.Value
+		n.ttls[key] = body.TTL
+		rw.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodDelete:
+		delete(n.values, key)
+		delete(n.ttls, key)
+	}
+}
+
+func (n *fakeNode) len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.values)
+}
+
+func startNodes(t *testing.T, count int) ([]*fakeNode, []string) {
+	var nodes []*fakeNode
+	var addrs []string
+	for i := 0; i < count; i++ {
+		node := &fakeNode{values: make(map[string]string), ttls: make(map[string]int64)}
+		server := httptest.NewServer(node)
+		t.Cleanup(server.Close)
+		nodes = append(nodes, node)
+		addrs = append(addrs, server.URL)
+	}
+	return nodes, addrs
+}
+
+func doRequest(t *testing.T, rt *Router, method, key, value string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body []byte
+	if value != "" {
+		body, _ = json.Marshal(map[string]string{"value": value, "type": "string"})
+	}
+	rw := httptest.NewRecorder()
+	rt.ServeHTTP(rw, httptest.NewRequest(method, "/db/"+key, bytes.NewReader(body)))
+	return rw
+}
+
+func getValue(t *testing.T, rt *Router, key string) string {
+	t.Helper()
+	rw := doRequest(t, rt, http.MethodGet, key, "")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("GET %s responded with %d", key, rw.Code)
+	}
+	var res item
+	if err := json.NewDecoder(rw.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Value
+}
+
+func waitMigration(t *testing.T, rt *Router) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for rt.Status().Adding != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Migration didn't finish: %+v", rt.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	nodes, addrs := startNodes(t, 3)
+	rt := NewRouter(http.DefaultClient, addrs[:2]...)
+
+	t.Run("forwards to the owner", func(t *testing.T) {
+		for i := 0; i < 250; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if rw := doRequest(t, rt, http.MethodPost, key, "value"+key); rw.Code != http.StatusCreated {
+				t.Fatalf("POST %s responded with %d", key, rw.Code)
+			}
+		}
+		if nodes[0].len()+nodes[1].len() != 250 || nodes[0].len() == 0 || nodes[1].len() == 0 {
+			t.Errorf("Keys are not spread over the nodes: %d and %d", nodes[0].len(), nodes[1].len())
+		}
+		if value := getValue(t, rt, "key7"); value != "valuekey7" {
+			t.Errorf("Bad value for key7: %s", value)
+		}
+
+		if rw := doRequest(t, rt, http.MethodGet, "", ""); rw.Code != http.StatusNotImplemented {
+			t.Errorf("Expected listing to be rejected, got %d", rw.Code)
+		}
+	})
+
+	t.Run("adds a node", func(t *testing.T) {
+		if err := rt.AddNode(addrs[2]); err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.AddNode(addrs[2]); err == nil {
+			t.Error("Expected an error while the node is being added")
+		}
+		// Requests made during the migration see the moved keys.
+		for i := 0; i < 250; i += 10 {
+			key := fmt.Sprintf("key%d", i)
+			if value := getValue(t, rt, key); value != "value"+key {
+				t.Fatalf("Bad value for %s during migration: %s", key, value)
+			}
+		}
+
+		waitMigration(t, rt)
+
+		status := rt.Status()
+		if len(status.Nodes) != 3 || status.Migrated != nodes[2].len() || status.Migrated == 0 {
+			t.Errorf("Unexpected status: %+v, the new node has %d keys", status, nodes[2].len())
+		}
+		if total := nodes[0].len() + nodes[1].len() + nodes[2].len(); total != 250 {
+			t.Errorf("Expected 250 keys over all nodes, got %d", total)
+		}
+		for i := 0; i < 250; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if value := getValue(t, rt, key); value != "value"+key {
+				t.Fatalf("Bad value for %s: %s", key, value)
+			}
+		}
+	})
+}
+
+func TestRouter_MovesTTL(t *testing.T) {
+	nodes, addrs := startNodes(t, 2)
+	rt := NewRouter(http.DefaultClient, addrs[0])
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		body, _ := json.Marshal(putBody{Value: "value", Type: "string", TTL: 60})
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db/"+key, bytes.NewReader(body)))
+		if rw.Code != http.StatusCreated {
+			t.Fatalf("POST %s responded with %d", key, rw.Code)
+		}
+	}
+	if err := rt.AddNode(addrs[1]); err != nil {
+		t.Fatal(err)
+	}
+	waitMigration(t, rt)
+
+	nodes[1].mu.Lock()
+	defer nodes[1].mu.Unlock()
+	if len(nodes[1].values) == 0 {
+		t.Fatal("Expected some keys to move")
+	}
+	for key, ttl := range nodes[1].ttls {
+		if ttl != 60 {
+			t.Errorf("Expected %s to keep its TTL, got %d", key, ttl)
+		}
+	}
+}
+
+func TestOpenRouter(t *testing.T) {
+	nodes, addrs := startNodes(t, 3)
+	path := filepath.Join(t.TempDir(), "ring.json")
+
+	rt, err := OpenRouter(http.DefaultClient, path, addrs[:2]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		doRequest(t, rt, http.MethodPost, key, "value"+key)
+	}
+
+	t.Run("keeps added nodes", func(t *testing.T) {
+		if err := rt.AddNode(addrs[2]); err != nil {
+			t.Fatal(err)
+		}
+		waitMigration(t, rt)
+
+		// Restarted with the nodes it was first given.
+		restarted, err := OpenRouter(http.DefaultClient, path, addrs[:2]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(restarted.Status().Nodes); n != 3 {
+			t.Fatalf("Expected 3 nodes, got %d", n)
+		}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if value := getValue(t, restarted, key); value != "value"+key {
+				t.Fatalf("Bad value for %s: %s", key, value)
+			}
+		}
+	})
+
+	t.Run("resumes an interrupted addition", func(t *testing.T) {
+		_, more := startNodes(t, 1)
+		state, _ := json.Marshal(routerState{Nodes: addrs, Adding: more[0]})
+		if err := os.WriteFile(path, state, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		restarted, err := OpenRouter(http.DefaultClient, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitMigration(t, restarted)
+		if n := len(restarted.Status().Nodes); n != 4 {
+			t.Fatalf("Expected 4 nodes, got %d", n)
+		}
+		if total := nodes[0].len() + nodes[1].len() + nodes[2].len(); total >= 100 {
+			t.Errorf("Expected some keys to move to the new node, %d are left", total)
+		}
+	})
+
+	t.Run("damaged file", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("garbage"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenRouter(http.DefaultClient, path, addrs...); err == nil {
+			t.Error("Expected an error for a damaged ring file")
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package sharding
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// routerState is what a Router keeps in its state file: the nodes of the ring
+// in the order they were added and the node being added, if any.
+type routerState struct {
+	Nodes  []string `json:"nodes"`
+	Adding string   `json:"adding,omitempty"`
+}
+
+// OpenRouter is like NewRouter but keeps the ring in the file at path. Once
+// the file exists, the nodes saved in it are used instead of the given ones,
+// so a restarted router still finds the keys moved to the nodes added since.
+// An addition interrupted by the restart is resumed.
+func OpenRouter(client *http.Client, path string, nodes ...string) (*Router, error) {
+	var state routerState
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil || len(state.Nodes) == 0 {
+			return nil, fmt.Errorf("invalid ring file %s", path)
+		}
+		if !sameNodes(state.Nodes, nodes) {
+			log.Printf("Using the nodes saved in %s: %v", path, state.Nodes)
+		}
+		nodes = state.Nodes
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	rt := NewRouter(client, nodes...)
+	rt.statePath = path
+	if state.Adding != "" {
+		return rt, rt.AddNode(state.Adding)
+	}
+	return rt, rt.save(routerState{Nodes: rt.ring.Nodes()})
+}
+
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// save replaces the state file, if the router has one, so a crash leaves
+// either the old state or the new one.
+func (rt *Router) save(state routerState) error {
+	if rt.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := rt.statePath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, rt.statePath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}